@@ -0,0 +1,134 @@
+package tao
+
+import (
+	"context"
+)
+
+// Principal represents the authenticated identity behind a connection.
+type Principal struct {
+	Name   string
+	Roles  []string
+	Scopes []string
+}
+
+// HasRole tells whether the principal has been granted role.
+func (p *Principal) HasRole(role string) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope tells whether the principal has been granted scope.
+func (p *Principal) HasScope(scope string) bool {
+	if p == nil {
+		return false
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is the access control list declared for a message number. A principal
+// is allowed if it has at least one of Roles and every one of Scopes, an empty
+// list imposes no restriction.
+type ACL struct {
+	Roles  []string
+	Scopes []string
+}
+
+// Allow tells whether the principal is permitted by acl. A nil acl allows
+// everyone, while a non-empty one always denies the nil principal.
+func (acl *ACL) Allow(p *Principal) bool {
+	if acl == nil || (len(acl.Roles) == 0 && len(acl.Scopes) == 0) {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	if len(acl.Roles) > 0 {
+		granted := false
+		for _, r := range acl.Roles {
+			if p.HasRole(r) {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			return false
+		}
+	}
+	for _, s := range acl.Scopes {
+		if !p.HasScope(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// RegisterOption sets options when registering a message.
+type RegisterOption func(*handlerUnmarshaler)
+
+// RolesOption returns a RegisterOption that restricts the message to principals
+// having at least one of roles.
+func RolesOption(roles ...string) RegisterOption {
+	return func(h *handlerUnmarshaler) {
+		if h.acl == nil {
+			h.acl = &ACL{}
+		}
+		h.acl.Roles = append(h.acl.Roles, roles...)
+	}
+}
+
+// ScopesOption returns a RegisterOption that restricts the message to principals
+// having all of scopes.
+func ScopesOption(scopes ...string) RegisterOption {
+	return func(h *handlerUnmarshaler) {
+		if h.acl == nil {
+			h.acl = &ACL{}
+		}
+		h.acl.Scopes = append(h.acl.Scopes, scopes...)
+	}
+}
+
+// NewContextWithPrincipal returns a new Context that carries principal.
+func NewContextWithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalCtx, p)
+}
+
+// PrincipalFromContext returns the principal within the context, or nil if the
+// connection has not been authenticated.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalCtx).(*Principal)
+	return p
+}
+
+// SetPrincipal binds the authenticated principal to server connection.
+func (sc *ServerConn) SetPrincipal(p *Principal) {
+	sc.SetContextValue(principalCtx, p)
+}
+
+// GetPrincipal returns the principal bound to server connection.
+func (sc *ServerConn) GetPrincipal() *Principal {
+	p, _ := sc.GetContextValue(principalCtx).(*Principal)
+	return p
+}
+
+// SetPrincipal binds the authenticated principal to client connection.
+func (cc *ClientConn) SetPrincipal(p *Principal) {
+	cc.SetContextValue(principalCtx, p)
+}
+
+// GetPrincipal returns the principal bound to client connection.
+func (cc *ClientConn) GetPrincipal() *Principal {
+	p, _ := cc.GetContextValue(principalCtx).(*Principal)
+	return p
+}
@@ -0,0 +1,131 @@
+package tao
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestACLAllow(t *testing.T) {
+	acl := &ACL{Roles: []string{"admin", "ops"}, Scopes: []string{"write", "audit"}}
+	for _, tc := range []struct {
+		name string
+		p    *Principal
+		want bool
+	}{
+		{"nil principal", nil, false},
+		{"one role all scopes", &Principal{Roles: []string{"ops"}, Scopes: []string{"audit", "write", "read"}}, true},
+		{"no role", &Principal{Roles: []string{"guest"}, Scopes: []string{"write", "audit"}}, false},
+		{"missing scope", &Principal{Roles: []string{"admin", "ops"}, Scopes: []string{"write"}}, false},
+	} {
+		if got := acl.Allow(tc.p); got != tc.want {
+			t.Errorf("%s: allowed %t, want %t", tc.name, got, tc.want)
+		}
+	}
+
+	var none *ACL
+	if !none.Allow(nil) || !(&ACL{}).Allow(nil) {
+		t.Fatal("empty ACL denied")
+	}
+}
+
+// aclClient connects to a server where textMessage requires role admin and
+// scope write, and numberMessage is open to everyone. Connections are bound to
+// principal, and denied messages are answered with "denied".
+func aclClient(t *testing.T, principal *Principal) (cc *ClientConn, handled <-chan Message, replies <-chan string) {
+	t.Helper()
+	handledCh := make(chan Message, 2)
+	sr := NewRouter()
+	Handle(sr, textMessageNumber, func(_ context.Context, m *textMessage, _ WriteCloser) error {
+		handledCh <- m
+		return nil
+	}, RolesOption("admin"), ScopesOption("write"))
+	Handle(sr, numberMessageNumber, func(_ context.Context, m numberMessage, _ WriteCloser) error {
+		handledCh <- m
+		return nil
+	})
+	_, addr := startServer(t, RouterOption(sr),
+		OnConnectOption(func(c WriteCloser) bool {
+			c.(*ServerConn).SetPrincipal(principal)
+			return true
+		}),
+		ACLDeniedOption(func(msg Message, p *Principal) Message {
+			return &textMessage{Text: "denied"}
+		}),
+	)
+
+	repliesCh := make(chan string, 1)
+	cr := NewRouter()
+	Handle(cr, textMessageNumber, func(_ context.Context, m *textMessage, _ WriteCloser) error {
+		repliesCh <- m.Text
+		return nil
+	})
+	cc, err := Dial(context.Background(), "tcp", addr, RouterOption(cr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Start()
+	t.Cleanup(cc.Close)
+	return cc, handledCh, repliesCh
+}
+
+func TestACLDenied(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		principal *Principal
+	}{
+		{"anonymous", nil},
+		{"no role", &Principal{Roles: []string{"guest"}, Scopes: []string{"write"}}},
+		{"missing scope", &Principal{Roles: []string{"admin"}, Scopes: []string{"read"}}},
+	} {
+		denied := deniedExported.Value()
+		cc, handled, replies := aclClient(t, tc.principal)
+		cc.Write(&textMessage{Text: "restricted"})
+		// handlers of a connection run in order, so the open message handled
+		// means the restricted one has been checked.
+		cc.Write(numberMessage(1))
+
+		select {
+		case msg := <-handled:
+			if msg != Message(numberMessage(1)) {
+				t.Fatalf("%s: handled %#v, want it denied", tc.name, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: open message not handled", tc.name)
+		}
+		select {
+		case reply := <-replies:
+			if reply != "denied" {
+				t.Fatalf("%s: replied %q, want denied", tc.name, reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: denied reply not sent", tc.name)
+		}
+		if n := deniedExported.Value() - denied; n != 1 {
+			t.Fatalf("%s: TotalDenied increased by %d, want 1", tc.name, n)
+		}
+	}
+}
+
+func TestACLAllowed(t *testing.T) {
+	denied := deniedExported.Value()
+	cc, handled, replies := aclClient(t, &Principal{Roles: []string{"ops", "admin"}, Scopes: []string{"write", "read"}})
+	cc.Write(&textMessage{Text: "restricted"})
+
+	select {
+	case msg := <-handled:
+		if m, ok := msg.(*textMessage); !ok || m.Text != "restricted" {
+			t.Fatalf("handled %#v, want the restricted message", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("allowed message not handled")
+	}
+	select {
+	case reply := <-replies:
+		t.Fatalf("replied %q to allowed message", reply)
+	default:
+	}
+	if n := deniedExported.Value() - denied; n != 0 {
+		t.Fatalf("TotalDenied increased by %d, want 0", n)
+	}
+}
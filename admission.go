@@ -0,0 +1,214 @@
+package tao
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// admissionRules are the rules evaluated on every accepted connection before
+// a ServerConn is allocated.
+type admissionRules struct {
+	allow      []*net.IPNet
+	deny       []*net.IPNet
+	maxPerIP   *int // nil if not set by option
+	cidrLimits []cidrLimit
+	acceptRate *rateLimit
+	admit      func(net.Conn) error
+}
+
+type cidrLimit struct {
+	ipnet *net.IPNet
+	max   int
+}
+
+// MaxConnsPerIPOption returns a ServerOption that limits the number of
+// connections from one remote IP, 0 means unlimited. It overrides
+// MaxConnsPerIP of ConfigOption, and is the MaxConnsPerIP returned by
+// Server.Config, so UpdateConfig changes it as well.
+func MaxConnsPerIPOption(max int) ServerOption {
+	return func(o *options) {
+		o.admission.maxPerIP = &max
+	}
+}
+
+// MaxConnsPerCIDROption returns a ServerOption that limits the total number of
+// connections from addresses within cidr. It panics if cidr is malformed.
+func MaxConnsPerCIDROption(cidr string, max int) ServerOption {
+	ipnet := mustParseNet(cidr)
+	return func(o *options) {
+		o.admission.cidrLimits = append(o.admission.cidrLimits, cidrLimit{ipnet, max})
+	}
+}
+
+// AllowListOption returns a ServerOption that only admits connections from the
+// listed IPs or CIDRs. It panics if any of them is malformed.
+func AllowListOption(cidrs ...string) ServerOption {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		nets[i] = mustParseNet(c)
+	}
+	return func(o *options) {
+		o.admission.allow = append(o.admission.allow, nets...)
+	}
+}
+
+// DenyListOption returns a ServerOption that refuses connections from the
+// listed IPs or CIDRs. It panics if any of them is malformed.
+func DenyListOption(cidrs ...string) ServerOption {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		nets[i] = mustParseNet(c)
+	}
+	return func(o *options) {
+		o.admission.deny = append(o.admission.deny, nets...)
+	}
+}
+
+// AcceptRateOption returns a ServerOption that limits accepted connections to
+// rate per second, allowing bursts of burst connections.
+func AcceptRateOption(rate float64, burst int) ServerOption {
+	return func(o *options) {
+		o.admission.acceptRate = &rateLimit{rate, burst}
+	}
+}
+
+// AdmitOption returns a ServerOption that will set a hook to call on every
+// accepted connection, the connection is refused if it returns an error.
+func AdmitOption(admit func(net.Conn) error) ServerOption {
+	return func(o *options) {
+		o.admission.admit = admit
+	}
+}
+
+// mustParseNet parses a CIDR or a bare IP into *net.IPNet.
+func mustParseNet(s string) *net.IPNet {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			panic(fmt.Sprintf("invalid IP address %q", s))
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(fmt.Sprintf("invalid CIDR %q: %v", s, err))
+	}
+	return ipnet
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admission keeps track of connections admitted by the rules.
+type admission struct {
+	rules    admissionRules
+	accept   *tokenBucket
+	mu       sync.Mutex // guards following
+	maxConns int
+	maxPerIP int
+	total    int
+	perIP    map[string]int
+	perNet   []int
+}
+
+func newAdmission(rules admissionRules, maxConns, maxPerIP int) *admission {
+	a := &admission{
+		rules:    rules,
+		maxConns: maxConns,
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int),
+		perNet:   make([]int, len(rules.cidrLimits)),
+	}
+	if rules.acceptRate != nil {
+		a.accept = newTokenBucket(*rules.acceptRate)
+	}
+	return a
+}
+
+// admit evaluates the rules on c, counting it in if admitted. The accept rate
+// token is taken last, so connections refused by other rules cost nothing.
+func (a *admission) admit(c net.Conn) error {
+	ipStr := remoteIP(c.RemoteAddr())
+	ip := net.ParseIP(ipStr)
+
+	if ip != nil && containsIP(a.rules.deny, ip) {
+		return ErrConnDenied
+	}
+	if len(a.rules.allow) > 0 && (ip == nil || !containsIP(a.rules.allow, ip)) {
+		return ErrConnDenied
+	}
+	if a.rules.admit != nil {
+		if err := a.rules.admit(c); err != nil {
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.total >= a.maxConns {
+		return ErrTooManyConns
+	}
+	if a.maxPerIP > 0 && a.perIP[ipStr] >= a.maxPerIP {
+		return ErrTooManyConns
+	}
+	for i, l := range a.rules.cidrLimits {
+		if ip != nil && l.ipnet.Contains(ip) && a.perNet[i] >= l.max {
+			return ErrTooManyConns
+		}
+	}
+	if a.accept != nil {
+		if _, ok := a.accept.take(false); !ok {
+			return ErrAcceptRateLimited
+		}
+	}
+	a.total++
+	a.perIP[ipStr]++
+	for i, l := range a.rules.cidrLimits {
+		if ip != nil && l.ipnet.Contains(ip) {
+			a.perNet[i]++
+		}
+	}
+	return nil
+}
+
+// setLimits adjusts the connection limits at runtime.
+func (a *admission) setLimits(maxConns, maxPerIP int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.maxConns = maxConns
+	a.maxPerIP = maxPerIP
+}
+
+// release counts out a connection previously admitted.
+func (a *admission) release(addr net.Addr) {
+	ipStr := remoteIP(addr)
+	ip := net.ParseIP(ipStr)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.total > 0 {
+		a.total--
+	}
+	if n := a.perIP[ipStr]; n <= 1 {
+		delete(a.perIP, ipStr)
+	} else {
+		a.perIP[ipStr] = n - 1
+	}
+	for i, l := range a.rules.cidrLimits {
+		if ip != nil && l.ipnet.Contains(ip) && a.perNet[i] > 0 {
+			a.perNet[i]--
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package tao
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// addrConn is a net.Conn from a remote address, only RemoteAddr is callable.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func connFrom(ip string) net.Conn {
+	return addrConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}}
+}
+
+func TestAdmissionLists(t *testing.T) {
+	var opts options
+	AllowListOption("10.0.0.0/8", "192.168.1.1")(&opts)
+	DenyListOption("10.1.0.0/16")(&opts)
+	a := newAdmission(opts.admission, MaxConnections, 0)
+
+	for _, tc := range []struct {
+		ip   string
+		want error
+	}{
+		{"10.0.0.1", nil},
+		{"192.168.1.1", nil},
+		{"10.1.2.3", ErrConnDenied}, // denied wins
+		{"192.168.1.2", ErrConnDenied},
+		{"8.8.8.8", ErrConnDenied},
+	} {
+		if err := a.admit(connFrom(tc.ip)); err != tc.want {
+			t.Errorf("admit %s got %v, want %v", tc.ip, err, tc.want)
+		}
+	}
+}
+
+func TestAdmissionPerIPAndCIDR(t *testing.T) {
+	var opts options
+	MaxConnsPerCIDROption("10.0.0.0/24", 3)(&opts)
+	a := newAdmission(opts.admission, MaxConnections, 2)
+
+	for _, tc := range []struct {
+		ip   string
+		want error
+	}{
+		{"10.0.0.1", nil},
+		{"10.0.0.1", nil},
+		{"10.0.0.1", ErrTooManyConns}, // per IP
+		{"10.0.0.2", nil},
+		{"10.0.0.3", ErrTooManyConns}, // per CIDR
+		{"10.0.1.1", nil},
+	} {
+		if err := a.admit(connFrom(tc.ip)); err != tc.want {
+			t.Fatalf("admit %s got %v, want %v", tc.ip, err, tc.want)
+		}
+	}
+
+	a.release(connFrom("10.0.0.1").RemoteAddr())
+	if err := a.admit(connFrom("10.0.0.3")); err != nil {
+		t.Fatalf("admit after released got %v", err)
+	}
+	if err := a.admit(connFrom("10.0.0.4")); err != ErrTooManyConns {
+		t.Fatalf("admit beyond CIDR limit got %v, want ErrTooManyConns", err)
+	}
+}
+
+func TestAdmissionTotalConcurrent(t *testing.T) {
+	const maxConns = 10
+	a := newAdmission(admissionRules{}, maxConns, 0)
+	admitted := NewAtomicInt32(0)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if a.admit(connFrom("127.0.0.1")) == nil {
+				admitted.IncrementAndGet()
+			}
+		}()
+	}
+	wg.Wait()
+	if n := admitted.Get(); n != maxConns {
+		t.Fatalf("admitted %d connections, want %d", n, maxConns)
+	}
+
+	a.release(connFrom("127.0.0.1").RemoteAddr())
+	if err := a.admit(connFrom("127.0.0.1")); err != nil {
+		t.Fatalf("admit after released got %v", err)
+	}
+}
+
+func TestAdmissionRateTokenLast(t *testing.T) {
+	var opts options
+	AcceptRateOption(0, 2)(&opts)
+	AdmitOption(func(c net.Conn) error {
+		if remoteIP(c.RemoteAddr()) == "10.0.0.9" {
+			return errors.New("refused by hook")
+		}
+		return nil
+	})(&opts)
+	a := newAdmission(opts.admission, MaxConnections, 1)
+
+	for _, tc := range []struct {
+		ip string
+		ok bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.1", false}, // per IP, no token taken
+		{"10.0.0.9", false}, // hook, no token taken
+		{"10.0.0.2", true},
+	} {
+		if err := a.admit(connFrom(tc.ip)); (err == nil) != tc.ok {
+			t.Fatalf("admit %s got %v", tc.ip, err)
+		}
+	}
+	if err := a.admit(connFrom("10.0.0.3")); err != ErrAcceptRateLimited {
+		t.Fatalf("admit beyond accept rate got %v, want ErrAcceptRateLimited", err)
+	}
+}
+
+func TestAdmissionReleaseOnClose(t *testing.T) {
+	s, addr := startServer(t, MaxConnsPerIPOption(1))
+	ids := connectClients(t, s, addr, 1)
+
+	// refused while the first one is connected
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection beyond limit not refused")
+	}
+
+	sc, _ := s.GetConn(ids[0])
+	sc.Close()
+	cc, err := Dial(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Start()
+	defer cc.Close()
+	deadline := time.Now().Add(time.Second)
+	for s.conns.Size() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not admitted after the other closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,319 @@
+package tao
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// SetAttribute sets attribute key of server connection, value must be of a
+// comparable type. Attributes are used by Filter of Server.Multicast, and kept
+// in secondary indexes if key is indexed by Server.IndexAttribute.
+func (sc *ServerConn) SetAttribute(key string, value interface{}) {
+	if value == nil || !reflect.TypeOf(value).Comparable() {
+		panic(fmt.Sprintf("attribute %s of type %T is not comparable", key, value))
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.attrs == nil {
+		sc.attrs = make(map[string]interface{})
+	}
+	old, ok := sc.attrs[key]
+	if ok && old == value {
+		return
+	}
+	sc.attrs[key] = value
+	if sc.ctx.Err() != nil {
+		// closed, already removed from indexes
+		return
+	}
+	ix := sc.belong.attrIndex
+	if ok {
+		ix.remove(key, old, sc.netid)
+	}
+	ix.add(key, value, sc)
+}
+
+// Attribute returns attribute key of server connection.
+func (sc *ServerConn) Attribute(key string) (interface{}, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	v, ok := sc.attrs[key]
+	return v, ok
+}
+
+// DeleteAttribute deletes attribute key of server connection.
+func (sc *ServerConn) DeleteAttribute(key string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if old, ok := sc.attrs[key]; ok {
+		delete(sc.attrs, key)
+		sc.belong.attrIndex.remove(key, old, sc.netid)
+	}
+}
+
+// unindexAttributes removes all the attributes from indexes when closing, it
+// must be called with sc.mu held.
+func (sc *ServerConn) unindexAttributes() {
+	for key, v := range sc.attrs {
+		sc.belong.attrIndex.remove(key, v, sc.netid)
+	}
+}
+
+// attrIndex indexes server connections by attribute values, locks of
+// connections must be taken before mu.
+type attrIndex struct {
+	mu  sync.RWMutex // guards following
+	idx map[string]map[interface{}]map[int64]*ServerConn
+}
+
+func newAttrIndex() *attrIndex {
+	return &attrIndex{
+		idx: make(map[string]map[interface{}]map[int64]*ServerConn),
+	}
+}
+
+func (ix *attrIndex) add(key string, value interface{}, sc *ServerConn) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	values, ok := ix.idx[key]
+	if !ok {
+		return
+	}
+	conns, ok := values[value]
+	if !ok {
+		conns = make(map[int64]*ServerConn)
+		values[value] = conns
+	}
+	conns[sc.netid] = sc
+}
+
+func (ix *attrIndex) remove(key string, value interface{}, netID int64) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	values, ok := ix.idx[key]
+	if !ok {
+		return
+	}
+	if conns, ok := values[value]; ok {
+		delete(conns, netID)
+		if len(conns) == 0 {
+			delete(values, value)
+		}
+	}
+}
+
+// lookup returns connections whose attribute key satisfies match, false if key
+// is not indexed.
+func (ix *attrIndex) lookup(key string, match func(interface{}) bool) ([]*ServerConn, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	values, ok := ix.idx[key]
+	if !ok {
+		return nil, false
+	}
+	var conns []*ServerConn
+	for v, cs := range values {
+		if !match(v) {
+			continue
+		}
+		for _, sc := range cs {
+			conns = append(conns, sc)
+		}
+	}
+	return conns, true
+}
+
+// IndexAttribute maintains a secondary index on attribute key, so filters on
+// it select connections without scanning all of them.
+func (s *Server) IndexAttribute(key string) {
+	ix := s.attrIndex
+	ix.mu.Lock()
+	if _, ok := ix.idx[key]; ok {
+		ix.mu.Unlock()
+		return
+	}
+	ix.idx[key] = make(map[interface{}]map[int64]*ServerConn)
+	ix.mu.Unlock()
+
+	// index the existing connections, concurrent updates are indexed by
+	// SetAttribute from now on.
+	s.conns.Range(func(sc *ServerConn) bool {
+		sc.mu.Lock()
+		if v, ok := sc.attrs[key]; ok && sc.ctx.Err() == nil {
+			ix.add(key, v, sc)
+		}
+		sc.mu.Unlock()
+		return true
+	})
+}
+
+// Filter selects server connections for Server.Multicast.
+type Filter interface {
+	Match(*ServerConn) bool
+}
+
+// indexedFilter is a Filter able to select candidates from indexes.
+type indexedFilter interface {
+	Filter
+	// candidates returns a superset of connections matched, false if indexes
+	// can not help.
+	candidates(ix *attrIndex) ([]*ServerConn, bool)
+}
+
+// FilterFunc is an adapter to use ordinary functions as Filter.
+type FilterFunc func(*ServerConn) bool
+
+// Match calls f(sc).
+func (f FilterFunc) Match(sc *ServerConn) bool {
+	return f(sc)
+}
+
+type attrFilter struct {
+	key   string
+	match func(interface{}) bool
+}
+
+func (f attrFilter) Match(sc *ServerConn) bool {
+	v, ok := sc.Attribute(f.key)
+	return ok && f.match(v)
+}
+
+func (f attrFilter) candidates(ix *attrIndex) ([]*ServerConn, bool) {
+	return ix.lookup(f.key, f.match)
+}
+
+// AttrEq returns a Filter selecting connections whose attribute key equals
+// value.
+func AttrEq(key string, value interface{}) Filter {
+	return attrFilter{key: key, match: func(v interface{}) bool {
+		c, ok := compareAttr(v, value)
+		return ok && c == 0
+	}}
+}
+
+// AttrGE returns a Filter selecting connections whose attribute key is greater
+// than or equal to value, both of numeric or string types.
+func AttrGE(key string, value interface{}) Filter {
+	return attrFilter{key: key, match: func(v interface{}) bool {
+		c, ok := compareAttr(v, value)
+		return ok && c >= 0
+	}}
+}
+
+// AttrLE returns a Filter selecting connections whose attribute key is less
+// than or equal to value, both of numeric or string types.
+func AttrLE(key string, value interface{}) Filter {
+	return attrFilter{key: key, match: func(v interface{}) bool {
+		c, ok := compareAttr(v, value)
+		return ok && c <= 0
+	}}
+}
+
+type allOf []Filter
+
+// AllOf returns a Filter selecting connections matched by all of filters.
+func AllOf(filters ...Filter) Filter {
+	return allOf(filters)
+}
+
+func (fs allOf) Match(sc *ServerConn) bool {
+	for _, f := range fs {
+		if !f.Match(sc) {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates takes the smallest candidate set of indexed filters.
+func (fs allOf) candidates(ix *attrIndex) ([]*ServerConn, bool) {
+	var (
+		best  []*ServerConn
+		found bool
+	)
+	for _, f := range fs {
+		inf, ok := f.(indexedFilter)
+		if !ok {
+			continue
+		}
+		if conns, ok := inf.candidates(ix); ok && (!found || len(conns) < len(best)) {
+			best, found = conns, true
+		}
+	}
+	return best, found
+}
+
+// compareAttr compares a with b, it returns false if they are not comparable
+// in order, numbers of different types are compared by value.
+func compareAttr(a, b interface{}) (int, bool) {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	switch {
+	case isInt(va) && isInt(vb):
+		return compareOrdered(va.Int(), vb.Int()), true
+	case isUint(va) && isUint(vb):
+		return compareOrdered(va.Uint(), vb.Uint()), true
+	case isNumber(va) && isNumber(vb):
+		return compareOrdered(toFloat(va), toFloat(vb)), true
+	case va.Kind() == reflect.String && vb.Kind() == reflect.String:
+		return compareOrdered(va.String(), vb.String()), true
+	case va.IsValid() && vb.IsValid() && va.Type() == vb.Type() && va.Type().Comparable():
+		if a == b {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func compareOrdered[T int64 | uint64 | float64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isUint(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+func isNumber(v reflect.Value) bool {
+	return isInt(v) || isUint(v) || v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch {
+	case isInt(v):
+		return float64(v.Int())
+	case isUint(v):
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+// Multicast sends msg to connections selected by filter, using secondary
+// indexes of attributes when possible. The message is encoded once, and
+// ErrBroadcast is returned if it could not be queued to some of them.
+func (s *Server) Multicast(filter Filter, msg Message) error {
+	if inf, ok := filter.(indexedFilter); ok {
+		if conns, ok := inf.candidates(s.attrIndex); ok {
+			return s.fanout(msg, conns, filter.Match)
+		}
+	}
+	return s.BroadcastFunc(msg, filter.Match)
+}
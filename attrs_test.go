@@ -0,0 +1,138 @@
+package tao
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/fanyang1988/tao/logger"
+)
+
+func TestCompareAttr(t *testing.T) {
+	for _, tc := range []struct {
+		a, b interface{}
+		c    int
+		ok   bool
+	}{
+		{1, 2, -1, true},
+		{int8(3), int64(3), 0, true},
+		{uint(5), uint16(4), 1, true},
+		{1, 1.5, -1, true},
+		{uint(2), -1, 1, true},
+		{"a", "b", -1, true},
+		{true, true, 0, true},
+		{true, false, 0, false},
+		{"1", 1, 0, false},
+	} {
+		c, ok := compareAttr(tc.a, tc.b)
+		if ok != tc.ok || ok && c != tc.c {
+			t.Errorf("compare %v with %v got (%d, %t), want (%d, %t)", tc.a, tc.b, c, ok, tc.c, tc.ok)
+		}
+	}
+}
+
+// netIDs returns the sorted net IDs of conns.
+func netIDs(conns []*ServerConn) []int64 {
+	ids := make([]int64, len(conns))
+	for i, sc := range conns {
+		ids[i] = sc.GetNetID()
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// attrServer returns a server with conns of attribute level of 0, 1, ...
+func attrServer(t *testing.T, n int) (*Server, []*ServerConn) {
+	t.Helper()
+	s := NewServer(logger.NewNullLogger())
+	t.Cleanup(s.Stop)
+	s.IndexAttribute("level")
+	conns := pipeServerConns(t, s, n)
+	for i, sc := range conns {
+		s.conns.Put(sc.GetNetID(), sc)
+		sc.SetAttribute("level", i)
+		sc.SetAttribute("vip", i%2 == 0)
+	}
+	return s, conns
+}
+
+func TestAttrFilters(t *testing.T) {
+	_, conns := attrServer(t, 6)
+	for _, tc := range []struct {
+		name   string
+		filter Filter
+		want   []int64
+	}{
+		{"eq", AttrEq("level", 2), []int64{2}},
+		{"ge", AttrGE("level", 4), []int64{4, 5}},
+		{"le", AttrLE("level", int64(1)), []int64{0, 1}},
+		{"all of", AllOf(AttrGE("level", 1), AttrEq("vip", true)), []int64{2, 4}},
+		{"missing", AttrEq("region", "eu"), []int64{}},
+		{"func", FilterFunc(func(sc *ServerConn) bool { return sc.GetNetID() == 3 }), []int64{3}},
+	} {
+		var matched []*ServerConn
+		for _, sc := range conns {
+			if tc.filter.Match(sc) {
+				matched = append(matched, sc)
+			}
+		}
+		if got := netIDs(matched); !equalIDs(got, tc.want) {
+			t.Errorf("%s: matched %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAttrIndex(t *testing.T) {
+	s, conns := attrServer(t, 6)
+	candidates := func(f Filter) []int64 {
+		t.Helper()
+		cs, ok := f.(indexedFilter).candidates(s.attrIndex)
+		if !ok {
+			t.Fatal("indexed attribute not looked up")
+		}
+		return netIDs(cs)
+	}
+
+	if got := candidates(AttrGE("level", 3)); !equalIDs(got, []int64{3, 4, 5}) {
+		t.Fatalf("candidates %v, want [3 4 5]", got)
+	}
+	if _, ok := AttrEq("vip", true).(indexedFilter).candidates(s.attrIndex); ok {
+		t.Fatal("attribute not indexed looked up")
+	}
+	// the indexed one narrows down
+	if got := candidates(AllOf(AttrEq("vip", true), AttrEq("level", 0))); !equalIDs(got, []int64{0}) {
+		t.Fatalf("candidates of all of %v, want [0]", got)
+	}
+
+	conns[5].SetAttribute("level", 0)
+	conns[4].DeleteAttribute("level")
+	if got := candidates(AttrEq("level", 0)); !equalIDs(got, []int64{0, 5}) {
+		t.Fatalf("candidates after updated %v, want [0 5]", got)
+	}
+	if got := candidates(AttrGE("level", 3)); !equalIDs(got, []int64{3}) {
+		t.Fatalf("candidates after updated %v, want [3]", got)
+	}
+
+	// existing attributes are indexed too
+	s.IndexAttribute("vip")
+	if got := candidates(AttrEq("vip", false)); !equalIDs(got, []int64{1, 3, 5}) {
+		t.Fatalf("candidates of attribute indexed later %v, want [1 3 5]", got)
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	s, conns := attrServer(t, 4)
+	msg := outboxMessage(0)
+	for _, filter := range []Filter{
+		AttrGE("level", 2), // by index
+		AttrEq("vip", true),
+	} {
+		if err := s.Multicast(filter, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, want := range []int{1, 0, 2, 1} {
+		if got := conns[i].sendQ.Len(); got != want {
+			t.Errorf("connection %d got %d messages, want %d", i, got, want)
+		}
+	}
+}
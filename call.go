@@ -0,0 +1,245 @@
+package tao
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrorCodeInternal is the code of ErrorMessage sent back for handler errors
+// which are not ErrorMessage themselves.
+const ErrorCodeInternal int32 = 500
+
+// internalErrorText is sent back for handler errors not safe to expose.
+const internalErrorText = "internal error"
+
+// Correlated is implemented by messages carrying a correlation ID, which
+// matches responses to requests made by Call. Handlers should copy the ID of
+// request into the response they write back.
+type Correlated interface {
+	Message
+	GetCorrelationID() uint64
+	SetCorrelationID(uint64)
+}
+
+// ErrorMessage is sent back to peer when a handler returns an error, and
+// returned as the error of Call. Handlers may return an ErrorMessage to choose
+// the code, other errors are sent with ErrorCodeInternal, carrying their text
+// only if marked by PublicError.
+type ErrorMessage struct {
+	Code          int32
+	Message       string
+	CorrelationID uint64
+}
+
+// Serialize serializes ErrorMessage into bytes.
+func (em ErrorMessage) Serialize() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, em.Code); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, em.CorrelationID); err != nil {
+		return nil, err
+	}
+	buf.WriteString(em.Message)
+	return buf.Bytes(), nil
+}
+
+// MessageNumber returns message number.
+func (em ErrorMessage) MessageNumber() int32 {
+	return ErrorMessageNumber
+}
+
+// GetCorrelationID returns the correlation ID of request failed.
+func (em ErrorMessage) GetCorrelationID() uint64 {
+	return em.CorrelationID
+}
+
+// SetCorrelationID sets the correlation ID of request failed.
+func (em *ErrorMessage) SetCorrelationID(id uint64) {
+	em.CorrelationID = id
+}
+
+func (em ErrorMessage) Error() string {
+	return fmt.Sprintf("remote error %d: %s", em.Code, em.Message)
+}
+
+// DeserializeErrorMessage deserializes bytes into Message.
+func DeserializeErrorMessage(data []byte) (Message, error) {
+	if data == nil {
+		return nil, ErrNilData
+	}
+	var em ErrorMessage
+	buf := bytes.NewReader(data)
+	if err := binary.Read(buf, binary.LittleEndian, &em.Code); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &em.CorrelationID); err != nil {
+		return nil, err
+	}
+	em.Message = string(data[len(data)-buf.Len():])
+	return em, nil
+}
+
+// asErrorMessage finds the first ErrorMessage in err's chain.
+func asErrorMessage(err error) (ErrorMessage, bool) {
+	var em ErrorMessage
+	if errors.As(err, &em) {
+		return em, true
+	}
+	var pem *ErrorMessage
+	if errors.As(err, &pem) && pem != nil {
+		return *pem, true
+	}
+	return em, false
+}
+
+// publicError is an error whose text is safe to be sent back to peer.
+type publicError struct {
+	err error
+}
+
+// PublicError marks err returned by handlers as safe to expose, its text is
+// sent back to peer with ErrorCodeInternal. Text of other errors is only
+// reported to OnConnErrorOption, peer receives "internal error" instead.
+func PublicError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return publicError{err}
+}
+
+func (pe publicError) Error() string {
+	return pe.err.Error()
+}
+
+func (pe publicError) Unwrap() error {
+	return pe.err
+}
+
+// replyError reports err returned by the handler of msg, and sends it back to
+// peer as ErrorMessage.
+func replyError(c WriteCloser, msg Message, err error) {
+	reportError(c, ErrorHandler, msg.MessageNumber(), err)
+	if msg.MessageNumber() == ErrorMessageNumber {
+		// never answer an error with another
+		return
+	}
+	em, ok := asErrorMessage(err)
+	if !ok {
+		em = ErrorMessage{Code: ErrorCodeInternal, Message: internalErrorText}
+		var pe publicError
+		if errors.As(err, &pe) {
+			em.Message = pe.Error()
+		}
+	}
+	if req, ok := msg.(Correlated); ok {
+		em.CorrelationID = req.GetCorrelationID()
+	}
+	c.Write(em)
+}
+
+// callTable holds the calls of client connection waiting for responses.
+type callTable struct {
+	mu      sync.Mutex // guards following
+	next    uint64
+	pending map[uint64]chan Message
+	closed  bool
+}
+
+func newCallTable() *callTable {
+	return &callTable{
+		pending: make(map[uint64]chan Message),
+	}
+}
+
+// add returns a new correlation ID and the channel its response is sent to.
+func (ct *callTable) add() (uint64, chan Message, error) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.closed {
+		return 0, nil, ErrConnClosed
+	}
+	ct.next++
+	ch := make(chan Message, 1)
+	ct.pending[ct.next] = ch
+	return ct.next, ch, nil
+}
+
+func (ct *callTable) remove(id uint64) {
+	ct.mu.Lock()
+	delete(ct.pending, id)
+	ct.mu.Unlock()
+}
+
+// deliver passes msg to the call waiting for it, it returns false if msg is
+// not a response to any.
+func (ct *callTable) deliver(msg Message) bool {
+	cm, ok := msg.(Correlated)
+	if !ok {
+		if em, isErr := msg.(ErrorMessage); isErr {
+			cm = &em
+		} else {
+			return false
+		}
+	}
+	id := cm.GetCorrelationID()
+	if id == 0 {
+		return false
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ch, ok := ct.pending[id]
+	if !ok {
+		return false
+	}
+	delete(ct.pending, id)
+	ch <- msg
+	return true
+}
+
+// close fails all the calls waiting.
+func (ct *callTable) close() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.closed = true
+	for id, ch := range ct.pending {
+		close(ch)
+		delete(ct.pending, id)
+	}
+}
+
+// Call writes msg with a new correlation ID and waits for the response
+// carrying the same ID, or ctx is done. If peer answers with an ErrorMessage,
+// it is returned as the error. msg must not be written concurrently elsewhere
+// since its correlation ID is set.
+func (cc *ClientConn) Call(ctx context.Context, msg Correlated) (Message, error) {
+	calls := cc.session().calls
+	id, ch, err := calls.add()
+	if err != nil {
+		return nil, err
+	}
+	defer calls.remove(id)
+
+	msg.SetCorrelationID(id)
+	if err = cc.Write(msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case rsp, ok := <-ch:
+		if !ok {
+			return nil, ErrConnClosed
+		}
+		if em, ok := rsp.(ErrorMessage); ok {
+			return nil, em
+		}
+		return rsp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
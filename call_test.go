@@ -0,0 +1,164 @@
+package tao
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const callMessageNumber = 12
+
+// callMessage is a Correlated message, encoded as the ID followed by text.
+type callMessage struct {
+	ID   uint64
+	Text string
+}
+
+func (m *callMessage) MessageNumber() int32 { return callMessageNumber }
+
+func (m *callMessage) Serialize() ([]byte, error) {
+	data := make([]byte, 8, 8+len(m.Text))
+	binary.LittleEndian.PutUint64(data, m.ID)
+	return append(data, m.Text...), nil
+}
+
+func (m *callMessage) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return errors.New("call message too short")
+	}
+	m.ID, m.Text = binary.LittleEndian.Uint64(data), string(data[8:])
+	return nil
+}
+
+func (m *callMessage) GetCorrelationID() uint64 { return m.ID }
+
+func (m *callMessage) SetCorrelationID(id uint64) { m.ID = id }
+
+func TestCallTable(t *testing.T) {
+	ct := newCallTable()
+	id1, ch1, _ := ct.add()
+	id2, ch2, _ := ct.add()
+	if id1 == 0 || id1 == id2 {
+		t.Fatalf("correlation IDs %d and %d", id1, id2)
+	}
+
+	for _, msg := range []Message{
+		&callMessage{ID: 0},
+		&callMessage{ID: id2 + 1},
+		outboxMessage(0), // not correlated
+	} {
+		if ct.deliver(msg) {
+			t.Fatalf("%#v delivered", msg)
+		}
+	}
+	rsp := &callMessage{ID: id1}
+	if !ct.deliver(rsp) || <-ch1 != Message(rsp) {
+		t.Fatal("response not delivered to its call")
+	}
+	if ct.deliver(rsp) {
+		t.Fatal("response delivered twice")
+	}
+	em := ErrorMessage{Code: 1, CorrelationID: id2}
+	if !ct.deliver(em) || <-ch2 != Message(em) {
+		t.Fatal("error not delivered to its call")
+	}
+
+	_, ch3, _ := ct.add()
+	ct.close()
+	if _, ok := <-ch3; ok {
+		t.Fatal("call waiting not failed after closed")
+	}
+	if _, _, err := ct.add(); err != ErrConnClosed {
+		t.Fatalf("add after closed got %v, want ErrConnClosed", err)
+	}
+}
+
+// callClient starts a server answering callMessage and returns a client
+// connected to it.
+func callClient(t *testing.T) *ClientConn {
+	t.Helper()
+	sr := NewRouter()
+	Handle(sr, callMessageNumber, func(_ context.Context, m *callMessage, c WriteCloser) error {
+		switch m.Text {
+		case "private":
+			return fmt.Errorf("query users: %w", errors.New("password authentication failed"))
+		case "public":
+			return fmt.Errorf("call: %w", PublicError(errors.New("bad request")))
+		case "coded":
+			return ErrorMessage{Code: 400, Message: "invalid"}
+		case "ignored":
+			return nil
+		}
+		return c.Write(&callMessage{ID: m.ID, Text: strings.ToUpper(m.Text)})
+	})
+	_, addr := startServer(t, RouterOption(sr))
+
+	cr := NewRouter()
+	Handle[*callMessage](cr, callMessageNumber, nil)
+	cc, err := Dial(context.Background(), "tcp", addr, RouterOption(cr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Start()
+	t.Cleanup(cc.Close)
+	return cc
+}
+
+func TestCallConcurrent(t *testing.T) {
+	cc := callClient(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			text := fmt.Sprintf("call %d", i)
+			rsp, err := cc.Call(context.Background(), &callMessage{Text: text})
+			if err != nil {
+				t.Errorf("%s: %v", text, err)
+				return
+			}
+			if got := rsp.(*callMessage).Text; got != strings.ToUpper(text) {
+				t.Errorf("%s answered with %q", text, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCallErrors(t *testing.T) {
+	cc := callClient(t)
+	for _, tc := range []struct {
+		text string
+		code int32
+		msg  string
+	}{
+		{"private", ErrorCodeInternal, internalErrorText},
+		{"public", ErrorCodeInternal, "bad request"},
+		{"coded", 400, "invalid"},
+	} {
+		_, err := cc.Call(context.Background(), &callMessage{Text: tc.text})
+		var em ErrorMessage
+		if !errors.As(err, &em) {
+			t.Fatalf("%s: got %v, want ErrorMessage", tc.text, err)
+		}
+		if em.Code != tc.code || em.Message != tc.msg {
+			t.Errorf("%s: got error %d %q, want %d %q", tc.text, em.Code, em.Message, tc.code, tc.msg)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := cc.Call(ctx, &callMessage{Text: "ignored"}); err != context.DeadlineExceeded {
+		t.Fatalf("call not answered got %v, want context.DeadlineExceeded", err)
+	}
+
+	cc.Close()
+	if _, err := cc.Call(context.Background(), &callMessage{Text: "closed"}); err != ErrConnClosed {
+		t.Fatalf("call on closed got %v, want ErrConnClosed", err)
+	}
+}
@@ -0,0 +1,373 @@
+package tao
+
+import (
+	"context"
+	"fmt"
+	"hash/maphash"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Balancer decides which connection of ClientPool a message goes to.
+type Balancer int
+
+// Balancers supported by ClientPool.
+const (
+	// RoundRobin picks connections in turn.
+	RoundRobin Balancer = iota
+	// LeastPending picks the connection with the fewest queued messages.
+	LeastPending
+	// ConsistentHash picks the connection by hashing the key of message, so
+	// messages of the same key go to the same backend as long as it is healthy.
+	ConsistentHash
+)
+
+const (
+	// virtualNodes is the number of points per connection on the hash ring.
+	virtualNodes = 64
+	// DefaultPoolDialTimeout is the dial timeout of ClientPool connections if
+	// none is set by DialTimeoutOption.
+	DefaultPoolDialTimeout = 5 * time.Second
+)
+
+type poolOptions struct {
+	size        int
+	balancer    Balancer
+	maxHeartAge time.Duration
+	checkInterv time.Duration
+	connOpts    []ServerOption
+	logger      LoggerInterface
+}
+
+// ClientPoolOption sets client pool options.
+type ClientPoolOption func(*poolOptions)
+
+// PoolSizeOption returns a ClientPoolOption that sets the number of connections
+// to each address, default 1.
+func PoolSizeOption(size int) ClientPoolOption {
+	return func(o *poolOptions) {
+		o.size = size
+	}
+}
+
+// BalancerOption returns a ClientPoolOption that sets the balancer, default
+// RoundRobin.
+func BalancerOption(b Balancer) ClientPoolOption {
+	return func(o *poolOptions) {
+		o.balancer = b
+	}
+}
+
+// MaxHeartBeatAgeOption returns a ClientPoolOption that drops connections not
+// hearing from peer for longer than age, 0 means never. It takes effect only if
+// heart beats are enabled by HeartbeatOption passed to PoolConnOption, quiet
+// connections are not dropped otherwise.
+func MaxHeartBeatAgeOption(age time.Duration) ClientPoolOption {
+	return func(o *poolOptions) {
+		o.maxHeartAge = age
+	}
+}
+
+// PoolConnOption returns a ClientPoolOption that applies opt to every client
+// connection of the pool. ReconnectOption should not be used since the pool
+// redials by itself.
+func PoolConnOption(opt ...ServerOption) ClientPoolOption {
+	return func(o *poolOptions) {
+		o.connOpts = append(o.connOpts, opt...)
+	}
+}
+
+// PoolLoggerOption returns a ClientPoolOption that sets logger of the pool.
+func PoolLoggerOption(logger LoggerInterface) ClientPoolOption {
+	return func(o *poolOptions) {
+		o.logger = logger
+	}
+}
+
+// ClientPool holds a number of client connections to a set of servers and
+// balances messages among the healthy ones.
+type ClientPool struct {
+	network string
+	addrs   []string
+	opts    poolOptions
+	next    *AtomicInt64
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      *sync.WaitGroup
+	seed    maphash.Seed
+	mu      sync.RWMutex             // guards following
+	conns   map[string][]*ClientConn // slots of each address, nil if missing
+	healthy []*ClientConn
+	ring    []ringNode
+}
+
+type ringNode struct {
+	hash uint64
+	conn *ClientConn
+}
+
+// NewClientPool returns a new client pool to addrs on network, which has not
+// started to connect yet.
+func NewClientPool(network string, addrs []string, opt ...ClientPoolOption) *ClientPool {
+	opts := poolOptions{
+		size:        1,
+		balancer:    RoundRobin,
+		checkInterv: time.Second,
+	}
+	for _, o := range opt {
+		o(&opts)
+	}
+	if opts.size <= 0 {
+		opts.size = 1
+	}
+	var connOpts options
+	for _, o := range opts.connOpts {
+		o(&connOpts)
+	}
+	if !connOpts.heartbeatEnabled() {
+		opts.maxHeartAge = 0
+	}
+	if opts.maxHeartAge > 0 && opts.maxHeartAge/2 < opts.checkInterv {
+		opts.checkInterv = opts.maxHeartAge / 2
+	}
+	if connOpts.dialTimeout <= 0 {
+		// not to block maintainLoop on unreachable addresses
+		opts.connOpts = append(opts.connOpts, DialTimeoutOption(DefaultPoolDialTimeout))
+	}
+
+	p := &ClientPool{
+		network: network,
+		addrs:   addrs,
+		opts:    opts,
+		next:    NewAtomicInt64(0),
+		wg:      &sync.WaitGroup{},
+		seed:    maphash.MakeSeed(),
+		conns:   make(map[string][]*ClientConn),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return p
+}
+
+// Start dials all the connections and keeps them healthy in background, it
+// returns an error only if no connection could be established.
+func (p *ClientPool) Start() error {
+	p.refill()
+	p.wg.Add(1)
+	go p.maintainLoop()
+	if p.Size() == 0 {
+		return fmt.Errorf("no connection established to %v", p.addrs)
+	}
+	return nil
+}
+
+// Close closes all connections of the pool.
+func (p *ClientPool) Close() {
+	p.cancel()
+	p.wg.Wait()
+
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = make(map[string][]*ClientConn)
+	p.rebuild()
+	p.mu.Unlock()
+
+	for _, cs := range conns {
+		for _, cc := range cs {
+			if cc != nil {
+				cc.Close()
+			}
+		}
+	}
+}
+
+// Size returns the number of healthy connections.
+func (p *ClientPool) Size() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.healthy)
+}
+
+// Write writes msg on a connection picked by the balancer.
+func (p *ClientPool) Write(msg Message) error {
+	cc, err := p.pick(nil)
+	if err != nil {
+		return err
+	}
+	return cc.Write(msg)
+}
+
+// WriteKey writes msg on the connection that key is hashed to when balancing
+// by ConsistentHash, key is ignored by other balancers. Keys must be
+// comparable, ErrNotHashable is returned otherwise.
+func (p *ClientPool) WriteKey(key interface{}, msg Message) error {
+	cc, err := p.pick(key)
+	if err != nil {
+		return err
+	}
+	return cc.Write(msg)
+}
+
+// Call writes msg on a connection picked by the balancer and waits for its
+// response or ctx is done, see ClientConn.Call.
+func (p *ClientPool) Call(ctx context.Context, msg Correlated) (Message, error) {
+	cc, err := p.pick(nil)
+	if err != nil {
+		return nil, err
+	}
+	return cc.Call(ctx, msg)
+}
+
+func (p *ClientPool) pick(key interface{}) (*ClientConn, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.healthy) == 0 {
+		return nil, ErrNoConn
+	}
+
+	switch p.opts.balancer {
+	case LeastPending:
+		var best *ClientConn
+		for _, cc := range p.healthy {
+			if best == nil || cc.Pending() < best.Pending() {
+				best = cc
+			}
+		}
+		return best, nil
+	case ConsistentHash:
+		if key != nil {
+			h, err := p.hash(key)
+			if err != nil {
+				return nil, err
+			}
+			i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+			if i == len(p.ring) {
+				i = 0
+			}
+			return p.ring[i].conn, nil
+		}
+	}
+	n := p.next.GetAndIncrement()
+	return p.healthy[n%int64(len(p.healthy))], nil
+}
+
+func (p *ClientPool) maintainLoop() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.opts.checkInterv)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.evict()
+			p.refill()
+		}
+	}
+}
+
+// evict closes and removes connections closed or not hearing from peer.
+func (p *ClientPool) evict() {
+	now := time.Now().UnixNano()
+	var dropped []*ClientConn
+
+	p.mu.Lock()
+	for _, cs := range p.conns {
+		for i, cc := range cs {
+			if cc == nil {
+				continue
+			}
+			age := time.Duration(now - cc.GetHeartBeat())
+			if cc.isClosed() || (p.opts.maxHeartAge > 0 && age > p.opts.maxHeartAge) {
+				dropped = append(dropped, cc)
+				cs[i] = nil
+			}
+		}
+	}
+	if len(dropped) > 0 {
+		p.rebuild()
+	}
+	p.mu.Unlock()
+
+	for _, cc := range dropped {
+		if p.opts.logger != nil {
+			p.opts.logger.Warnf("drop unhealthy connection to %s\n", cc.addr)
+		}
+		cc.Close()
+	}
+}
+
+// refill dials connections into empty slots of each address.
+func (p *ClientPool) refill() {
+	for _, addr := range p.addrs {
+		var missing []int
+		p.mu.RLock()
+		slots := p.conns[addr]
+		for i := 0; i < p.opts.size; i++ {
+			if i >= len(slots) || slots[i] == nil {
+				missing = append(missing, i)
+			}
+		}
+		p.mu.RUnlock()
+
+		for _, slot := range missing {
+			cc, err := Dial(p.ctx, p.network, addr, p.opts.connOpts...)
+			if err != nil {
+				if p.opts.logger != nil {
+					p.opts.logger.Errorf("pool dial %s error %v\n", addr, err)
+				}
+				break
+			}
+			cc.Start()
+
+			p.mu.Lock()
+			if p.ctx.Err() != nil {
+				p.mu.Unlock()
+				cc.Close()
+				return
+			}
+			if p.conns[addr] == nil {
+				p.conns[addr] = make([]*ClientConn, p.opts.size)
+			}
+			p.conns[addr][slot] = cc
+			p.rebuild()
+			p.mu.Unlock()
+		}
+	}
+}
+
+// rebuild rebuilds the healthy list and hash ring, it must be called with
+// p.mu held. Points of a connection on the ring are keyed by its slot, so the
+// one refilled takes the place of the evicted one and others never move.
+func (p *ClientPool) rebuild() {
+	p.healthy = p.healthy[:0]
+	p.ring = p.ring[:0]
+	for _, addr := range p.addrs {
+		for i, cc := range p.conns[addr] {
+			if cc == nil {
+				continue
+			}
+			p.healthy = append(p.healthy, cc)
+			for v := 0; v < virtualNodes; v++ {
+				p.ring = append(p.ring, ringNode{
+					hash: maphash.String(p.seed, fmt.Sprintf("%s#%d#%d", addr, i, v)),
+					conn: cc,
+				})
+			}
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+}
+
+// hash hashes key onto the ring, equal keys of any comparable type hash
+// equally.
+func (p *ClientPool) hash(key interface{}) (uint64, error) {
+	if !reflect.TypeOf(key).Comparable() {
+		return 0, ErrNotHashable
+	}
+	var h maphash.Hash
+	h.SetSeed(p.seed)
+	hashKey(&h, key)
+	return h.Sum64(), nil
+}
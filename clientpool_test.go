@@ -0,0 +1,149 @@
+package tao
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeClient returns a client connection not started on one end of a pipe.
+func pipeClient(t *testing.T) *ClientConn {
+	t.Helper()
+	client, server := net.Pipe()
+	cc := NewClientConn(0, client)
+	t.Cleanup(func() {
+		cc.Close()
+		server.Close()
+	})
+	return cc
+}
+
+// fillPool puts client connections into every empty slot of p.
+func fillPool(t *testing.T, p *ClientPool) {
+	t.Helper()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, addr := range p.addrs {
+		if p.conns[addr] == nil {
+			p.conns[addr] = make([]*ClientConn, p.opts.size)
+		}
+		for i, cc := range p.conns[addr] {
+			if cc == nil {
+				p.conns[addr][i] = pipeClient(t)
+			}
+		}
+	}
+	p.rebuild()
+}
+
+func TestPoolRingStable(t *testing.T) {
+	p := NewClientPool("tcp", []string{"a", "b"}, PoolSizeOption(2), BalancerOption(ConsistentHash))
+	fillPool(t, p)
+
+	const keys = 1000
+	before := make([]*ClientConn, keys)
+	for k := range before {
+		before[k], _ = p.pick(k)
+	}
+
+	p.mu.Lock()
+	evicted := p.conns["a"][1]
+	p.conns["a"][1] = nil
+	p.rebuild()
+	p.mu.Unlock()
+	for k, cc := range before {
+		if cc == evicted {
+			continue
+		}
+		if got, _ := p.pick(k); got != cc {
+			t.Fatalf("key %d moved after evicting another connection", k)
+		}
+	}
+
+	fillPool(t, p)
+	refilled := p.conns["a"][1]
+	for k, cc := range before {
+		got, _ := p.pick(k)
+		if cc == evicted && got != refilled || cc != evicted && got != cc {
+			t.Fatalf("key %d not restored after refilled", k)
+		}
+	}
+}
+
+func TestPoolEvictQuiet(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    []ServerOption
+		evicted bool
+	}{
+		{"without heart beats", nil, false},
+		{"with heart beats", []ServerOption{HeartbeatOption(time.Hour, time.Hour)}, true},
+	} {
+		p := NewClientPool("tcp", []string{"a"},
+			MaxHeartBeatAgeOption(time.Millisecond), PoolConnOption(tc.opts...))
+		fillPool(t, p)
+		p.conns["a"][0].SetHeartBeat(time.Now().Add(-time.Second).UnixNano())
+		p.evict()
+		if evicted := p.Size() == 0; evicted != tc.evicted {
+			t.Errorf("%s: quiet connection evicted %t, want %t", tc.name, evicted, tc.evicted)
+		}
+	}
+}
+
+func TestPoolDialTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		opts []ServerOption
+		want time.Duration
+	}{
+		{nil, DefaultPoolDialTimeout},
+		{[]ServerOption{DialTimeoutOption(time.Second)}, time.Second},
+	} {
+		p := NewClientPool("tcp", []string{"a"}, PoolConnOption(tc.opts...))
+		if got := newClientOptions(p.opts.connOpts).dialTimeout; got != tc.want {
+			t.Errorf("dial timeout %v, want %v", got, tc.want)
+		}
+	}
+}
+
+type userID string
+
+type shardKey struct {
+	Tenant string
+	ID     int
+}
+
+func TestPoolWriteKey(t *testing.T) {
+	p := NewClientPool("tcp", []string{"a", "b"}, PoolSizeOption(2), BalancerOption(ConsistentHash))
+	fillPool(t, p)
+
+	for _, key := range []interface{}{userID("alice"), shardKey{"acme", 1}} {
+		cc, err := p.pick(key)
+		if err != nil {
+			t.Fatalf("pick %#v got %v", key, err)
+		}
+		pending := cc.Pending()
+		if err = p.WriteKey(key, outboxMessage(0)); err != nil {
+			t.Fatalf("WriteKey %#v got %v", key, err)
+		}
+		if cc.Pending() != pending+1 {
+			t.Fatalf("WriteKey %#v written to another connection", key)
+		}
+	}
+
+	// keys are hashed by value, not all to one connection
+	picked := make(map[*ClientConn]bool)
+	for i := 0; i < 100; i++ {
+		cc, _ := p.pick(shardKey{"acme", i})
+		picked[cc] = true
+		cc, _ = p.pick(userID(fmt.Sprint(i)))
+		picked[cc] = true
+	}
+	if len(picked) != 4 {
+		t.Fatalf("keys picked %d connections, want 4", len(picked))
+	}
+
+	if err := p.WriteKey([]int{1}, outboxMessage(0)); err != ErrNotHashable {
+		t.Fatalf("WriteKey slice got %v, want ErrNotHashable", err)
+	}
+}
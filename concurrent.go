@@ -8,7 +8,11 @@ ConcurrentMap
 package tao
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/maphash"
+	"math"
+	"reflect"
 	"sync"
 	"sync/atomic"
 )
@@ -24,7 +28,7 @@ func NewAtomicInt64(initialValue int64) *AtomicInt64 {
 
 // Get returns the value of int64 atomically.
 func (a *AtomicInt64) Get() int64 {
-	return int64(*a)
+	return atomic.LoadInt64((*int64)(a))
 }
 
 // Set sets the value of int64 atomically.
@@ -34,12 +38,7 @@ func (a *AtomicInt64) Set(newValue int64) {
 
 // GetAndSet sets new value and returns the old atomically.
 func (a *AtomicInt64) GetAndSet(newValue int64) int64 {
-	for {
-		current := a.Get()
-		if a.CompareAndSet(current, newValue) {
-			return current
-		}
-	}
+	return atomic.SwapInt64((*int64)(a), newValue)
 }
 
 // CompareAndSet compares int64 with expected value, if equals as expected
@@ -51,74 +50,37 @@ func (a *AtomicInt64) CompareAndSet(expect, update int64) bool {
 // GetAndIncrement gets the old value and then increment by 1, this operation
 // performs atomically.
 func (a *AtomicInt64) GetAndIncrement() int64 {
-	for {
-		current := a.Get()
-		next := current + 1
-		if a.CompareAndSet(current, next) {
-			return current
-		}
-	}
-
+	return a.AddAndGet(1) - 1
 }
 
 // GetAndDecrement gets the old value and then decrement by 1, this operation
 // performs atomically.
 func (a *AtomicInt64) GetAndDecrement() int64 {
-	for {
-		current := a.Get()
-		next := current - 1
-		if a.CompareAndSet(current, next) {
-			return current
-		}
-	}
+	return a.AddAndGet(-1) + 1
 }
 
 // GetAndAdd gets the old value and then add by delta, this operation
 // performs atomically.
 func (a *AtomicInt64) GetAndAdd(delta int64) int64 {
-	for {
-		current := a.Get()
-		next := current + delta
-		if a.CompareAndSet(current, next) {
-			return current
-		}
-	}
+	return a.AddAndGet(delta) - delta
 }
 
 // IncrementAndGet increments the value by 1 and then gets the value, this
 // operation performs atomically.
 func (a *AtomicInt64) IncrementAndGet() int64 {
-	for {
-		current := a.Get()
-		next := current + 1
-		if a.CompareAndSet(current, next) {
-			return next
-		}
-	}
+	return a.AddAndGet(1)
 }
 
 // DecrementAndGet decrements the value by 1 and then gets the value, this
 // operation performs atomically.
 func (a *AtomicInt64) DecrementAndGet() int64 {
-	for {
-		current := a.Get()
-		next := current - 1
-		if a.CompareAndSet(current, next) {
-			return next
-		}
-	}
+	return a.AddAndGet(-1)
 }
 
 // AddAndGet adds the value by delta and then gets the value, this operation
 // performs atomically.
 func (a *AtomicInt64) AddAndGet(delta int64) int64 {
-	for {
-		current := a.Get()
-		next := current + delta
-		if a.CompareAndSet(current, next) {
-			return next
-		}
-	}
+	return atomic.AddInt64((*int64)(a), delta)
 }
 
 func (a *AtomicInt64) String() string {
@@ -128,7 +90,7 @@ func (a *AtomicInt64) String() string {
 // AtomicInt32 provides atomic int32 type.
 type AtomicInt32 int32
 
-// NewAtomicInt32 returns an atomoic int32 type.
+// NewAtomicInt32 returns an atomic int32 type.
 func NewAtomicInt32(initialValue int32) *AtomicInt32 {
 	a := AtomicInt32(initialValue)
 	return &a
@@ -136,7 +98,7 @@ func NewAtomicInt32(initialValue int32) *AtomicInt32 {
 
 // Get returns the value of int32 atomically.
 func (a *AtomicInt32) Get() int32 {
-	return int32(*a)
+	return atomic.LoadInt32((*int32)(a))
 }
 
 // Set sets the value of int32 atomically.
@@ -145,16 +107,11 @@ func (a *AtomicInt32) Set(newValue int32) {
 }
 
 // GetAndSet sets new value and returns the old atomically.
-func (a *AtomicInt32) GetAndSet(newValue int32) (oldValue int32) {
-	for {
-		oldValue = a.Get()
-		if a.CompareAndSet(oldValue, newValue) {
-			return
-		}
-	}
+func (a *AtomicInt32) GetAndSet(newValue int32) int32 {
+	return atomic.SwapInt32((*int32)(a), newValue)
 }
 
-// CompareAndSet compares int64 with expected value, if equals as expected
+// CompareAndSet compares int32 with expected value, if equals as expected
 // then sets the updated value, this operation performs atomically.
 func (a *AtomicInt32) CompareAndSet(expect, update int32) bool {
 	return atomic.CompareAndSwapInt32((*int32)(a), expect, update)
@@ -163,74 +120,37 @@ func (a *AtomicInt32) CompareAndSet(expect, update int32) bool {
 // GetAndIncrement gets the old value and then increment by 1, this operation
 // performs atomically.
 func (a *AtomicInt32) GetAndIncrement() int32 {
-	for {
-		current := a.Get()
-		next := current + 1
-		if a.CompareAndSet(current, next) {
-			return current
-		}
-	}
-
+	return a.AddAndGet(1) - 1
 }
 
 // GetAndDecrement gets the old value and then decrement by 1, this operation
 // performs atomically.
 func (a *AtomicInt32) GetAndDecrement() int32 {
-	for {
-		current := a.Get()
-		next := current - 1
-		if a.CompareAndSet(current, next) {
-			return current
-		}
-	}
+	return a.AddAndGet(-1) + 1
 }
 
 // GetAndAdd gets the old value and then add by delta, this operation
 // performs atomically.
 func (a *AtomicInt32) GetAndAdd(delta int32) int32 {
-	for {
-		current := a.Get()
-		next := current + delta
-		if a.CompareAndSet(current, next) {
-			return current
-		}
-	}
+	return a.AddAndGet(delta) - delta
 }
 
 // IncrementAndGet increments the value by 1 and then gets the value, this
 // operation performs atomically.
 func (a *AtomicInt32) IncrementAndGet() int32 {
-	for {
-		current := a.Get()
-		next := current + 1
-		if a.CompareAndSet(current, next) {
-			return next
-		}
-	}
+	return a.AddAndGet(1)
 }
 
 // DecrementAndGet decrements the value by 1 and then gets the value, this
 // operation performs atomically.
 func (a *AtomicInt32) DecrementAndGet() int32 {
-	for {
-		current := a.Get()
-		next := current - 1
-		if a.CompareAndSet(current, next) {
-			return next
-		}
-	}
+	return a.AddAndGet(-1)
 }
 
 // AddAndGet adds the value by delta and then gets the value, this operation
 // performs atomically.
 func (a *AtomicInt32) AddAndGet(delta int32) int32 {
-	for {
-		current := a.Get()
-		next := current + delta
-		if a.CompareAndSet(current, next) {
-			return next
-		}
-	}
+	return atomic.AddInt32((*int32)(a), delta)
 }
 
 func (a *AtomicInt32) String() string {
@@ -285,69 +205,301 @@ func (a *AtomicBoolean) CompareAndSet(oldValue, newValue bool) bool {
 
 // GetAndSet sets new value and returns the old atomically.
 func (a *AtomicBoolean) GetAndSet(newValue bool) bool {
-	for {
-		current := a.Get()
-		if a.CompareAndSet(current, newValue) {
-			return current
-		}
+	var n int32
+	if newValue {
+		n = 1
 	}
+	return atomic.SwapInt32((*int32)(a), n) != 0
 }
 
 func (a *AtomicBoolean) String() string {
 	return fmt.Sprintf("%t", a.Get())
 }
 
-// ConnMap is a safe map for server connection management.
-type ConnMap struct {
+// concurrentMapShards is the number of shards of ConcurrentMap, must be a
+// power of 2.
+const concurrentMapShards = 32
+
+// ConcurrentMap is a go-routine safe map, it is split into shards by hash of
+// keys so that go-routines working on different keys contend less.
+type ConcurrentMap[K comparable, V any] struct {
+	seed   maphash.Seed
+	shards [concurrentMapShards]mapShard[K, V]
+}
+
+type mapShard[K comparable, V any] struct {
 	sync.RWMutex
-	m map[int64]*ServerConn
+	m map[K]V
+}
+
+// NewConcurrentMap returns a new ConcurrentMap.
+func NewConcurrentMap[K comparable, V any]() *ConcurrentMap[K, V] {
+	cm := &ConcurrentMap[K, V]{seed: maphash.MakeSeed()}
+	for i := range cm.shards {
+		cm.shards[i].m = make(map[K]V)
+	}
+	return cm
+}
+
+func (cm *ConcurrentMap[K, V]) shard(key K) *mapShard[K, V] {
+	var h maphash.Hash
+	h.SetSeed(cm.seed)
+	hashKey(&h, key)
+	return &cm.shards[h.Sum64()&(concurrentMapShards-1)]
+}
+
+// hashKey writes key into h so that equal keys hash equally, the common key
+// types are written directly and others are walked by reflection.
+func hashKey(h *maphash.Hash, key interface{}) {
+	var buf [8]byte
+	switch k := key.(type) {
+	case string:
+		h.WriteString(k)
+	case int:
+		binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		h.Write(buf[:])
+	case int64:
+		binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		h.Write(buf[:])
+	case int32:
+		binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		h.Write(buf[:])
+	case uint64:
+		binary.LittleEndian.PutUint64(buf[:], k)
+		h.Write(buf[:])
+	case uint32:
+		binary.LittleEndian.PutUint64(buf[:], uint64(k))
+		h.Write(buf[:])
+	default:
+		hashValue(h, reflect.ValueOf(key))
+	}
+}
+
+func hashValue(h *maphash.Hash, v reflect.Value) {
+	var buf [8]byte
+	put := func(u uint64) {
+		binary.LittleEndian.PutUint64(buf[:], u)
+		h.Write(buf[:])
+	}
+	putFloat := func(f float64) {
+		if f == 0 {
+			f = 0 // -0 equals to +0
+		}
+		put(math.Float64bits(f))
+	}
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		put(0)
+	case reflect.Bool:
+		if v.Bool() {
+			put(1)
+		} else {
+			put(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		put(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		put(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		putFloat(v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		putFloat(real(c))
+		putFloat(imag(c))
+	case reflect.String:
+		h.WriteString(v.String())
+	case reflect.Ptr, reflect.Chan, reflect.UnsafePointer:
+		put(uint64(v.Pointer()))
+	case reflect.Interface:
+		if v.IsNil() {
+			put(0)
+		} else {
+			hashValue(h, v.Elem())
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			hashValue(h, v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			hashValue(h, v.Field(i))
+		}
+	default:
+		panic(fmt.Sprintf("key of type %s is not comparable", v.Type()))
+	}
+}
+
+// Get returns the value of key, and whether it is present.
+func (cm *ConcurrentMap[K, V]) Get(key K) (V, bool) {
+	sh := cm.shard(key)
+	sh.RLock()
+	v, ok := sh.m[key]
+	sh.RUnlock()
+	return v, ok
+}
+
+// Put sets the value of key.
+func (cm *ConcurrentMap[K, V]) Put(key K, value V) {
+	sh := cm.shard(key)
+	sh.Lock()
+	sh.m[key] = value
+	sh.Unlock()
+}
+
+// PutIfAbsent sets the value of key if it is not present, it returns the
+// value in map and whether it was present already.
+func (cm *ConcurrentMap[K, V]) PutIfAbsent(key K, value V) (V, bool) {
+	sh := cm.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	if v, ok := sh.m[key]; ok {
+		return v, true
+	}
+	sh.m[key] = value
+	return value, false
+}
+
+// ComputeIfAbsent returns the value of key, computing it by f and putting it
+// in map if not present. f is called at most once per absent key, with the
+// shard of key locked, so it must not access the map.
+func (cm *ConcurrentMap[K, V]) ComputeIfAbsent(key K, f func(K) V) V {
+	sh := cm.shard(key)
+	sh.RLock()
+	v, ok := sh.m[key]
+	sh.RUnlock()
+	if ok {
+		return v
+	}
+
+	sh.Lock()
+	defer sh.Unlock()
+	if v, ok = sh.m[key]; ok {
+		return v
+	}
+	v = f(key)
+	sh.m[key] = v
+	return v
+}
+
+// Remove removes key from map, it returns the value removed and whether it
+// was present.
+func (cm *ConcurrentMap[K, V]) Remove(key K) (V, bool) {
+	sh := cm.shard(key)
+	sh.Lock()
+	v, ok := sh.m[key]
+	delete(sh.m, key)
+	sh.Unlock()
+	return v, ok
+}
+
+// Clear clears all elements in map.
+func (cm *ConcurrentMap[K, V]) Clear() {
+	for i := range cm.shards {
+		sh := &cm.shards[i]
+		sh.Lock()
+		sh.m = make(map[K]V)
+		sh.Unlock()
+	}
+}
+
+// Size returns map size.
+func (cm *ConcurrentMap[K, V]) Size() int {
+	size := 0
+	for i := range cm.shards {
+		sh := &cm.shards[i]
+		sh.RLock()
+		size += len(sh.m)
+		sh.RUnlock()
+	}
+	return size
+}
+
+// IsEmpty tells whether map is empty.
+func (cm *ConcurrentMap[K, V]) IsEmpty() bool {
+	return cm.Size() <= 0
+}
+
+// Range calls f for each key and value until f returns false. A shard is
+// copied before calling f on it, so f may modify the map and does not block
+// others, elements put or removed during Range may or may not be visited.
+func (cm *ConcurrentMap[K, V]) Range(f func(K, V) bool) {
+	type entry struct {
+		key   K
+		value V
+	}
+	var entries []entry
+	for i := range cm.shards {
+		sh := &cm.shards[i]
+		sh.RLock()
+		entries = entries[:0]
+		for k, v := range sh.m {
+			entries = append(entries, entry{k, v})
+		}
+		sh.RUnlock()
+		for _, e := range entries {
+			if !f(e.key, e.value) {
+				return
+			}
+		}
+	}
+}
+
+// ConnMap is a safe map for server connection management, it is sharded by
+// net ID so that accepting and closing connections contend less.
+type ConnMap struct {
+	m *ConcurrentMap[int64, *ServerConn]
 }
 
 // NewConnMap returns a new ConnMap.
 func NewConnMap() *ConnMap {
-	return &ConnMap{
-		m: make(map[int64]*ServerConn),
-	}
+	return &ConnMap{m: NewConcurrentMap[int64, *ServerConn]()}
 }
 
 // Clear clears all elements in map.
 func (cm *ConnMap) Clear() {
-	cm.Lock()
-	cm.m = make(map[int64]*ServerConn)
-	cm.Unlock()
+	cm.m.Clear()
 }
 
 // Get gets a server connection with specified net ID.
 func (cm *ConnMap) Get(id int64) (*ServerConn, bool) {
-	cm.RLock()
-	sc, ok := cm.m[id]
-	cm.RUnlock()
-	return sc, ok
+	return cm.m.Get(id)
 }
 
 // Put puts a server connection with specified net ID in map.
 func (cm *ConnMap) Put(id int64, sc *ServerConn) {
-	cm.Lock()
-	cm.m[id] = sc
-	cm.Unlock()
+	cm.m.Put(id, sc)
 }
 
 // Remove removes a server connection with specified net ID.
 func (cm *ConnMap) Remove(id int64) {
-	cm.Lock()
-	delete(cm.m, id)
-	cm.Unlock()
+	cm.m.Remove(id)
 }
 
 // Size returns map size.
 func (cm *ConnMap) Size() int {
-	cm.RLock()
-	size := len(cm.m)
-	cm.RUnlock()
-	return size
+	return cm.m.Size()
 }
 
 // IsEmpty tells whether ConnMap is empty.
 func (cm *ConnMap) IsEmpty() bool {
-	return cm.Size() <= 0
+	return cm.m.IsEmpty()
+}
+
+// Range calls f for each server connection until f returns false, it does not
+// block connections from being put or removed, see ConcurrentMap.Range.
+func (cm *ConnMap) Range(f func(*ServerConn) bool) {
+	cm.m.Range(func(_ int64, sc *ServerConn) bool {
+		return f(sc)
+	})
+}
+
+// Snapshot returns all the server connections in map at the moment.
+func (cm *ConnMap) Snapshot() []*ServerConn {
+	conns := make([]*ServerConn, 0, cm.Size())
+	cm.Range(func(sc *ServerConn) bool {
+		conns = append(conns, sc)
+		return true
+	})
+	return conns
 }
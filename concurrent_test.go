@@ -0,0 +1,231 @@
+package tao
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/fanyang1988/tao/logger"
+)
+
+const (
+	stressWorkers = 8
+	stressRounds  = 1000
+)
+
+// stress runs f concurrently in stressWorkers go-routines.
+func stress(f func(worker int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < stressWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentMapKeys(t *testing.T) {
+	t.Parallel()
+	type point struct {
+		x, y int
+		name string
+	}
+	var zero float64
+	negZero := -zero
+	a, b := new(int), new(int)
+
+	cm := NewConcurrentMap[interface{}, int]()
+	for i, k := range []interface{}{"key", 42, int8(42), 1.5, 0.0, point{1, 2, "p"}, [2]string{"a", "b"}, a, b, nil} {
+		cm.Put(k, i)
+	}
+	for _, tc := range []struct {
+		key  interface{}
+		want int
+	}{
+		{"key", 0},
+		{42, 1},
+		{int8(42), 2},
+		{negZero, 4},
+		{point{1, 2, "p"}, 5},
+		{[2]string{"a", "b"}, 6},
+		{b, 8},
+		{nil, 9},
+	} {
+		if v, ok := cm.Get(tc.key); !ok || v != tc.want {
+			t.Errorf("get %v got (%d, %t), want %d", tc.key, v, ok, tc.want)
+		}
+	}
+	if size := cm.Size(); size != 10 {
+		t.Fatalf("size %d, want 10", size)
+	}
+}
+
+func TestConcurrentMapComputeIfAbsent(t *testing.T) {
+	t.Parallel()
+	cm := NewConcurrentMap[int, int]()
+	calls := NewAtomicInt64(0)
+	stress(func(int) {
+		for i := 0; i < stressRounds; i++ {
+			v := cm.ComputeIfAbsent(i, func(k int) int {
+				calls.IncrementAndGet()
+				return k * 2
+			})
+			if v != i*2 {
+				t.Errorf("compute %d got %d", i, v)
+				return
+			}
+		}
+	})
+	if n := calls.Get(); n != stressRounds {
+		t.Fatalf("computed %d times, want %d", n, stressRounds)
+	}
+}
+
+func TestConcurrentMapPutIfAbsent(t *testing.T) {
+	t.Parallel()
+	cm := NewConcurrentMap[int, int]()
+	winners := make([]AtomicInt32, stressRounds)
+	stress(func(worker int) {
+		for i := 0; i < stressRounds; i++ {
+			if v, loaded := cm.PutIfAbsent(i, worker); !loaded {
+				winners[i].IncrementAndGet()
+			} else if got, _ := cm.Get(i); got != v {
+				t.Errorf("key %d got %d, want %d put", i, got, v)
+				return
+			}
+		}
+	})
+	for i := range winners {
+		if n := winners[i].Get(); n != 1 {
+			t.Fatalf("key %d put %d times, want once", i, n)
+		}
+	}
+}
+
+func TestConcurrentMapRange(t *testing.T) {
+	t.Parallel()
+	cm := NewConcurrentMap[int, int]()
+	// keys below stressRounds are never removed
+	for i := 0; i < stressRounds; i++ {
+		cm.Put(i, i)
+	}
+	stress(func(worker int) {
+		if worker%2 == 0 {
+			for i := 0; i < stressRounds; i++ {
+				k := stressRounds*(worker+1) + i
+				cm.Put(k, k)
+				cm.Remove(k)
+			}
+			return
+		}
+		for r := 0; r < 10; r++ {
+			seen := 0
+			cm.Range(func(k, v int) bool {
+				if k != v {
+					t.Errorf("key %d of value %d", k, v)
+				}
+				if k < stressRounds {
+					seen++
+				}
+				// modifying the map in f must not dead lock
+				cm.Put(k%stressRounds, k%stressRounds)
+				return true
+			})
+			if seen != stressRounds {
+				t.Errorf("ranged %d stable keys, want %d", seen, stressRounds)
+				return
+			}
+		}
+	})
+}
+
+func TestAtomicIntegers(t *testing.T) {
+	t.Parallel()
+	a32, a64 := NewAtomicInt32(0), NewAtomicInt64(0)
+	max32, max64 := NewAtomicInt32(0), NewAtomicInt64(0)
+	stress(func(int) {
+		for i := 0; i < stressRounds; i++ {
+			a32.GetAndIncrement()
+			a32.IncrementAndGet()
+			a32.GetAndAdd(3)
+			a32.DecrementAndGet()
+			a64.GetAndIncrement()
+			a64.AddAndGet(5)
+			a64.GetAndDecrement()
+
+			// keep the maximum by compare and set
+			for v := int32(i); ; {
+				old := max32.Get()
+				if old >= v || max32.CompareAndSet(old, v) {
+					break
+				}
+			}
+			for v := int64(i); ; {
+				old := max64.Get()
+				if old >= v || max64.CompareAndSet(old, v) {
+					break
+				}
+			}
+		}
+	})
+	if got, want := a32.Get(), int32(4*stressWorkers*stressRounds); got != want {
+		t.Errorf("int32 got %d, want %d", got, want)
+	}
+	if got, want := a64.Get(), int64(5*stressWorkers*stressRounds); got != want {
+		t.Errorf("int64 got %d, want %d", got, want)
+	}
+	if max32.Get() != stressRounds-1 || max64.Get() != stressRounds-1 {
+		t.Errorf("maximums %d and %d, want %d", max32.Get(), max64.Get(), stressRounds-1)
+	}
+	if old := a64.GetAndSet(-1); old != 5*stressWorkers*stressRounds || a64.Get() != -1 {
+		t.Errorf("get and set got %d then %d", old, a64.Get())
+	}
+}
+
+func TestConnMapConcurrent(t *testing.T) {
+	t.Parallel()
+	s := NewServer(logger.NewNullLogger())
+	defer s.Stop()
+	conns := pipeServerConns(t, s, stressWorkers*2)
+	cm := NewConnMap()
+	// the first half stays in map
+	for _, sc := range conns[:stressWorkers] {
+		cm.Put(sc.GetNetID(), sc)
+	}
+
+	stress(func(worker int) {
+		sc := conns[stressWorkers+worker]
+		for i := 0; i < stressRounds/10; i++ {
+			cm.Put(sc.GetNetID(), sc)
+			if got, ok := cm.Get(sc.GetNetID()); !ok || got != sc {
+				t.Errorf("connection %d not got after put", sc.GetNetID())
+				return
+			}
+
+			stable := 0
+			cm.Range(func(c *ServerConn) bool {
+				if c.GetNetID() < stressWorkers {
+					stable++
+				}
+				return true
+			})
+			if stable != stressWorkers {
+				t.Errorf("ranged %d stable connections, want %d", stable, stressWorkers)
+				return
+			}
+			if n := len(cm.Snapshot()); n < stressWorkers || n > 2*stressWorkers {
+				t.Errorf("snapshot of %d connections", n)
+				return
+			}
+			cm.Remove(sc.GetNetID())
+		}
+	})
+	if size := cm.Size(); size != stressWorkers {
+		t.Fatalf("size %d, want %d", size, stressWorkers)
+	}
+	cm.Clear()
+	if !cm.IsEmpty() {
+		t.Fatal("not empty after cleared")
+	}
+}
@@ -0,0 +1,177 @@
+package tao
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// DefaultQueueSize is the default buffer size of connection and timer queues.
+	DefaultQueueSize = 1024
+)
+
+// ServerConfig holds the tunables of server and connections. It can be loaded
+// from JSON by ParseServerConfig, or from YAML or TOML by decoding into the
+// value returned by DefaultServerConfig, and is applied by ConfigOption.
+// Zero fields take the default values.
+//
+// MaxConnections, MaxConnsPerIP, WorkersNum and MaxWorkers are safe to adjust
+// on a running server by calling UpdateConfig, the others take effect on new
+// server only.
+type ServerConfig struct {
+	// MaxConnections is the maximum number of client connections allowed.
+	MaxConnections int `json:"max_connections" yaml:"max_connections" toml:"max_connections"`
+	// MaxConnsPerIP is the maximum number of connections from one remote IP,
+	// 0 means unlimited. MaxConnsPerIPOption overrides it.
+	MaxConnsPerIP int `json:"max_conns_per_ip" yaml:"max_conns_per_ip" toml:"max_conns_per_ip"`
+	// WorkersNum is the minimum number of worker go-routines running handlers.
+	WorkersNum int `json:"workers_num" yaml:"workers_num" toml:"workers_num"`
+	// MaxWorkers is the maximum number of worker go-routines, the pool grows
+	// up to it when handlers wait in queue for too long.
+	MaxWorkers int `json:"max_workers" yaml:"max_workers" toml:"max_workers"`
+	// SendQueueSize is the buffer size of outbound messages of normal priority
+	// per connection, high and low priorities have a quarter of it each in
+	// addition.
+	SendQueueSize int `json:"send_queue_size" yaml:"send_queue_size" toml:"send_queue_size"`
+	// HandlerQueueSize is the buffer size of inbound messages of normal
+	// priority per connection, sized for other priorities as SendQueueSize.
+	HandlerQueueSize int `json:"handler_queue_size" yaml:"handler_queue_size" toml:"handler_queue_size"`
+	// TimerQueueSize is the buffer size of timeout callbacks per connection,
+	// timers beyond it are dropped and reported as ErrorOverflow.
+	TimerQueueSize int `json:"timer_queue_size" yaml:"timer_queue_size" toml:"timer_queue_size"`
+	// TimingWheelQueueSize is the buffer size of the TimingWheel channels.
+	TimingWheelQueueSize int `json:"timing_wheel_queue_size" yaml:"timing_wheel_queue_size" toml:"timing_wheel_queue_size"`
+}
+
+// DefaultServerConfig returns the configuration used when none is provided.
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		MaxConnections:       MaxConnections,
+		WorkersNum:           WorkersNum,
+		MaxWorkers:           MaxWorkersNum,
+		SendQueueSize:        DefaultQueueSize,
+		HandlerQueueSize:     DefaultQueueSize,
+		TimerQueueSize:       DefaultQueueSize,
+		TimingWheelQueueSize: DefaultQueueSize,
+	}
+}
+
+// ParseServerConfig parses JSON data into a ServerConfig, fields absent from
+// data take the default values.
+func ParseServerConfig(data []byte) (ServerConfig, error) {
+	cfg := DefaultServerConfig()
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	cfg.setDefaults()
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the configuration for invalid values.
+func (cfg ServerConfig) Validate() error {
+	fields := []struct {
+		name  string
+		value int
+	}{
+		{"max_connections", cfg.MaxConnections},
+		{"workers_num", cfg.WorkersNum},
+		{"send_queue_size", cfg.SendQueueSize},
+		{"handler_queue_size", cfg.HandlerQueueSize},
+		{"timer_queue_size", cfg.TimerQueueSize},
+		{"timing_wheel_queue_size", cfg.TimingWheelQueueSize},
+	}
+	for _, f := range fields {
+		if f.value <= 0 {
+			return fmt.Errorf("invalid config %s %d, must be positive", f.name, f.value)
+		}
+	}
+	if cfg.MaxWorkers < cfg.WorkersNum {
+		return fmt.Errorf("invalid config max_workers %d, must not be less than workers_num %d",
+			cfg.MaxWorkers, cfg.WorkersNum)
+	}
+	if cfg.MaxConnsPerIP < 0 {
+		return fmt.Errorf("invalid config max_conns_per_ip %d, must not be negative", cfg.MaxConnsPerIP)
+	}
+	return nil
+}
+
+func (cfg *ServerConfig) setDefaults() {
+	def := DefaultServerConfig()
+	if cfg.MaxConnections == 0 {
+		cfg.MaxConnections = def.MaxConnections
+	}
+	if cfg.WorkersNum == 0 {
+		cfg.WorkersNum = def.WorkersNum
+	}
+	if cfg.MaxWorkers == 0 {
+		cfg.MaxWorkers = def.MaxWorkers
+		if cfg.MaxWorkers < cfg.WorkersNum {
+			cfg.MaxWorkers = cfg.WorkersNum
+		}
+	}
+	if cfg.SendQueueSize == 0 {
+		cfg.SendQueueSize = def.SendQueueSize
+	}
+	if cfg.HandlerQueueSize == 0 {
+		cfg.HandlerQueueSize = def.HandlerQueueSize
+	}
+	if cfg.TimerQueueSize == 0 {
+		cfg.TimerQueueSize = def.TimerQueueSize
+	}
+	if cfg.TimingWheelQueueSize == 0 {
+		cfg.TimingWheelQueueSize = def.TimingWheelQueueSize
+	}
+}
+
+// ConfigOption returns a ServerOption that will apply cfg, it is validated
+// when creating server and NewServer panics if it is invalid.
+func ConfigOption(cfg ServerConfig) ServerOption {
+	return func(o *options) {
+		o.config = &cfg
+	}
+}
+
+// resolveConfig returns the configuration to apply with the options.
+func resolveConfig(opts options) ServerConfig {
+	cfg := DefaultServerConfig()
+	if opts.config != nil {
+		cfg = *opts.config
+		cfg.setDefaults()
+	}
+	if opts.admission.maxPerIP != nil {
+		cfg.MaxConnsPerIP = *opts.admission.maxPerIP
+	}
+	return cfg
+}
+
+// Config returns the configuration server is running with.
+func (s *Server) Config() ServerConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+// UpdateConfig adjusts a running server, only MaxConnections, MaxConnsPerIP,
+// WorkersNum and MaxWorkers can be changed, an error is returned if cfg is
+// invalid or changes others.
+func (s *Server) UpdateConfig(cfg ServerConfig) error {
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	immutable := s.config
+	immutable.MaxConnections = cfg.MaxConnections
+	immutable.MaxConnsPerIP = cfg.MaxConnsPerIP
+	immutable.WorkersNum = cfg.WorkersNum
+	immutable.MaxWorkers = cfg.MaxWorkers
+	if immutable != cfg {
+		return fmt.Errorf("only max_connections, max_conns_per_ip, workers_num and max_workers can be changed on a running server")
+	}
+	s.config = cfg
+	s.admission.setLimits(cfg.MaxConnections, cfg.MaxConnsPerIP)
+	s.workers.SetSize(cfg.WorkersNum, cfg.MaxWorkers)
+	return nil
+}
@@ -0,0 +1,127 @@
+package tao
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fanyang1988/tao/logger"
+)
+
+func TestServerConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(*ServerConfig)
+		field  string // in the error, empty if valid
+	}{
+		{"default", func(*ServerConfig) {}, ""},
+		{"unlimited per ip", func(c *ServerConfig) { c.MaxConnsPerIP = 0 }, ""},
+		{"no connections", func(c *ServerConfig) { c.MaxConnections = 0 }, "max_connections"},
+		{"negative workers", func(c *ServerConfig) { c.WorkersNum = -1 }, "workers_num"},
+		{"no send queue", func(c *ServerConfig) { c.SendQueueSize = 0 }, "send_queue_size"},
+		{"no handler queue", func(c *ServerConfig) { c.HandlerQueueSize = 0 }, "handler_queue_size"},
+		{"no timer queue", func(c *ServerConfig) { c.TimerQueueSize = 0 }, "timer_queue_size"},
+		{"no timing wheel queue", func(c *ServerConfig) { c.TimingWheelQueueSize = 0 }, "timing_wheel_queue_size"},
+		{"max workers below", func(c *ServerConfig) { c.MaxWorkers = c.WorkersNum - 1 }, "max_workers"},
+		{"negative per ip", func(c *ServerConfig) { c.MaxConnsPerIP = -1 }, "max_conns_per_ip"},
+	} {
+		cfg := DefaultServerConfig()
+		tc.modify(&cfg)
+		err := cfg.Validate()
+		if tc.field == "" && err != nil {
+			t.Errorf("%s: got %v, want valid", tc.name, err)
+		} else if tc.field != "" && (err == nil || !strings.Contains(err.Error(), tc.field)) {
+			t.Errorf("%s: got %v, want %s invalid", tc.name, err, tc.field)
+		}
+	}
+}
+
+func TestParseServerConfig(t *testing.T) {
+	for _, tc := range []struct {
+		data  string
+		check func(ServerConfig) bool
+		ok    bool
+	}{
+		{`{}`, func(c ServerConfig) bool { return c == DefaultServerConfig() }, true},
+		{`{"max_connections": 5, "max_conns_per_ip": 2}`, func(c ServerConfig) bool {
+			return c.MaxConnections == 5 && c.MaxConnsPerIP == 2 && c.WorkersNum == WorkersNum
+		}, true},
+		// zero takes the default
+		{`{"send_queue_size": 0}`, func(c ServerConfig) bool { return c.SendQueueSize == DefaultQueueSize }, true},
+		// max_workers takes the default below workers_num
+		{`{"workers_num": 500}`, nil, false},
+		{`{"max_conns_per_ip": -1}`, nil, false},
+		{`{"max_connections": "many"}`, nil, false},
+	} {
+		cfg, err := ParseServerConfig([]byte(tc.data))
+		if (err == nil) != tc.ok {
+			t.Errorf("parse %s got %v", tc.data, err)
+			continue
+		}
+		if tc.check != nil && !tc.check(cfg) {
+			t.Errorf("parse %s got %+v", tc.data, cfg)
+		}
+	}
+}
+
+func TestResolveConfig(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.MaxConnsPerIP = 5
+	for _, tc := range []struct {
+		name string
+		opt  []ServerOption
+		want int
+	}{
+		{"none", nil, 0},
+		{"config", []ServerOption{ConfigOption(cfg)}, 5},
+		{"option", []ServerOption{MaxConnsPerIPOption(3)}, 3},
+		{"option over config", []ServerOption{MaxConnsPerIPOption(3), ConfigOption(cfg)}, 3},
+		{"option of unlimited", []ServerOption{ConfigOption(cfg), MaxConnsPerIPOption(0)}, 0},
+	} {
+		var opts options
+		for _, o := range tc.opt {
+			o(&opts)
+		}
+		if got := resolveConfig(opts).MaxConnsPerIP; got != tc.want {
+			t.Errorf("%s: max conns per ip %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	s := NewServer(logger.NewNullLogger(), MaxConnsPerIPOption(2))
+	defer s.Stop()
+
+	// the option's limit is kept when updating from Config
+	cfg := s.Config()
+	cfg.MaxConnections = 100
+	cfg.WorkersNum, cfg.MaxWorkers = 4, 8
+	if err := s.UpdateConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Config(); got != cfg || got.MaxConnsPerIP != 2 {
+		t.Fatalf("config %+v after updated, want %+v", got, cfg)
+	}
+	s.admission.mu.Lock()
+	maxConns, maxPerIP := s.admission.maxConns, s.admission.maxPerIP
+	s.admission.mu.Unlock()
+	if maxConns != 100 || maxPerIP != 2 {
+		t.Fatalf("admission limits %d and %d, want 100 and 2", maxConns, maxPerIP)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func(*ServerConfig)
+	}{
+		{"immutable", func(c *ServerConfig) { c.SendQueueSize *= 2 }},
+		{"invalid", func(c *ServerConfig) { c.MaxWorkers = c.WorkersNum - 1 }},
+	} {
+		bad := s.Config()
+		tc.modify(&bad)
+		if err := s.UpdateConfig(bad); err == nil {
+			t.Errorf("%s: updated", tc.name)
+		}
+		if got := s.Config(); got != cfg {
+			t.Errorf("%s: config %+v changed", tc.name, got)
+		}
+	}
+}
@@ -2,7 +2,8 @@ package tao
 
 import (
 	"context"
-	"crypto/tls"
+	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -20,7 +21,7 @@ const (
 // MessageHandler is a combination of message and its handler function.
 type MessageHandler struct {
 	message Message
-	handler HandlerFunc
+	handler handleFunc
 }
 
 // WriteCloser is the interface that groups Write and Close methods.
@@ -33,41 +34,45 @@ type WriteCloser interface {
 
 // ServerConn represents a server connection to a TCP server, it implments Conn.
 type ServerConn struct {
-	once      *sync.Once
-	wg        *sync.WaitGroup
-	sendCh    chan writeData
-	handlerCh chan MessageHandler
-	timerCh   chan *OnTimeOut
-	netid   int64
-	belong  *Server
-	rawConn net.Conn
-	mu      sync.Mutex // guards following
-	name    string
-	heart   int64
-	pending []int64
-	ctx     context.Context
-	cancel  context.CancelFunc
-	logger LoggerInterface
+	once     *sync.Once
+	wg       *sync.WaitGroup
+	sendQ    *priorityQueue[writeData]
+	handlerQ *priorityQueue[MessageHandler]
+	timerCh  chan *OnTimeOut
+	netid    int64
+	belong   *Server
+	rawConn  net.Conn
+	mu       sync.Mutex // guards following
+	name     string
+	heart    int64
+	pending  []int64
+	attrs    map[string]interface{}
+	version  uint32
+	limiter  *connLimiter
+	ctx      context.Context
+	cancel   context.CancelFunc
+	logger   LoggerInterface
 }
 
 // NewServerConn returns a new server connection which has not started to
 // serve requests yet.
 func NewServerConn(id int64, s *Server, c net.Conn) *ServerConn {
 	sc := &ServerConn{
-		netid:     id,
-		belong:    s,
-		rawConn:   c,
-		once:      &sync.Once{},
-		wg:        &sync.WaitGroup{},
-		sendCh:    make(chan writeData, 1024),
-		handlerCh: make(chan MessageHandler, 1024),
-		timerCh:   make(chan *OnTimeOut, 1024),
-		heart:     time.Now().UnixNano(),
-		logger:s.logger,
+		netid:    id,
+		belong:   s,
+		rawConn:  c,
+		once:     &sync.Once{},
+		wg:       &sync.WaitGroup{},
+		sendQ:    newPriorityQueue[writeData](s.config.SendQueueSize, s.opts.scheduling),
+		handlerQ: newPriorityQueue[MessageHandler](s.config.HandlerQueueSize, s.opts.scheduling),
+		timerCh:  make(chan *OnTimeOut, s.config.TimerQueueSize),
+		heart:    time.Now().UnixNano(),
+		logger:   s.logger,
 	}
 	sc.ctx, sc.cancel = context.WithCancel(context.WithValue(s.ctx, serverCtx, s))
 	sc.name = c.RemoteAddr().String()
 	sc.pending = []int64{}
+	sc.limiter = newConnLimiter(s, c.RemoteAddr())
 	return sc
 }
 
@@ -133,10 +138,23 @@ func (sc *ServerConn) Start() {
 		sc.logger.Infof("conn start, <%v -> %v>\n",
 			sc.rawConn.LocalAddr(), sc.rawConn.RemoteAddr())
 	}
+	if err := sc.handshake(); err != nil {
+		if sc.logger != nil {
+			sc.logger.Errorf("error handshaking %v\n", err)
+		}
+		kind := ErrorHandshake
+		if _, ok := err.(ErrTimeout); ok {
+			kind = ErrorTimeout
+		}
+		reportError(sc, kind, noMessage, err)
+		sc.Close()
+		return
+	}
 	onConnect := sc.belong.opts.onConnect
 	if onConnect != nil {
 		onConnect(sc)
 	}
+	sc.startHeartBeat()
 
 	loopers := []func(WriteCloser, *sync.WaitGroup){readLoop, writeLoop, handleLoop}
 	for _, l := range loopers {
@@ -164,11 +182,17 @@ func (sc *ServerConn) Close() {
 		// remove connection from server
 		sc.logger.Tracef("remove %v", sc.netid)
 		sc.belong.conns.Remove(sc.netid)
+		sc.belong.pubsub.removeConn(sc.netid)
+		sc.belong.groups.removeConn(sc.netid)
 		addTotalConn(-1)
+		sc.belong.admission.release(sc.rawConn.RemoteAddr())
+		if sc.limiter != nil {
+			sc.limiter.release()
+		}
 
 		// close net.Conn, any blocked read or write operation will be unblocked and
 		// return errors.
-		if tc, ok := sc.rawConn.(*net.TCPConn); ok {
+		if tc, ok := sc.rawConn.(lingerer); ok {
 			// avoid time-wait state
 			tc.SetLinger(0)
 		}
@@ -179,6 +203,7 @@ func (sc *ServerConn) Close() {
 		sc.cancel()
 		pending := sc.pending
 		sc.pending = nil
+		sc.unindexAttributes()
 		sc.mu.Unlock()
 
 		// clean up pending timers
@@ -190,8 +215,8 @@ func (sc *ServerConn) Close() {
 		sc.wg.Wait()
 
 		// close all channels and block until all go-routines exited.
-		close(sc.sendCh)
-		close(sc.handlerCh)
+		sc.sendQ.close()
+		sc.handlerQ.close()
 		close(sc.timerCh)
 
 		// tell server I'm done.
@@ -212,13 +237,37 @@ func (sc *ServerConn) AddPendingTimer(timerID int64) {
 
 // Write writes a message to the client.
 func (sc *ServerConn) Write(message Message) error {
-	return asyncWrite(sc, message, nil)
+	return asyncWrite(sc, message, priorityOf(sc.belong.opts.router, message), nil)
+}
+
+// WriteWithPriority writes a message to the client at priority p instead of
+// the one declared for its message number.
+func (sc *ServerConn) WriteWithPriority(message Message, p Priority) error {
+	return asyncWrite(sc, message, p, nil)
+}
+
+// writeFrame queues f encoded from msg, taking a reference released after
+// written.
+func (sc *ServerConn) writeFrame(f *frame, msg Message, p Priority) (err error) {
+	f.retain()
+	defer func() {
+		if r := recover(); r != nil {
+			f.release()
+			err = ErrServerClosed
+		}
+	}()
+	if !sc.sendQ.tryPush(p, writeData{data: f.data, msg: msg, frame: f}) {
+		f.release()
+		reportError(sc, ErrorOverflow, messageNumber(msg), ErrWouldBlock)
+		return ErrWouldBlock
+	}
+	return nil
 }
 
 func (cc *ServerConn) WriteByRes(message Message) error {
 	resChan := make(chan bool, 1)
-	err := asyncWrite(cc, message, resChan)
-	if err != nil{
+	err := asyncWrite(cc, message, priorityOf(cc.belong.opts.router, message), resChan)
+	if err != nil {
 		return err
 	}
 
@@ -278,56 +327,109 @@ func (sc *ServerConn) LocalAddr() net.Addr {
 
 // ClientConn represents a client connection to a TCP server.
 type ClientConn struct {
-	addr      string
-	opts      options
-	netid     int64
-	rawConn   net.Conn
-	once      *sync.Once
-	wg        *sync.WaitGroup
-	sendCh    chan writeData
-	handlerCh chan MessageHandler
-	timing    *TimingWheel
-	mu        sync.Mutex // guards following
-	name      string
-	heart     int64
-	pending   []int64
-	ctx       context.Context
-	cancel    context.CancelFunc
-	logger LoggerInterface
+	network string
+	addr    string
+	opts    options
+	netid   int64
+	mu      sync.Mutex // guards following
+	name    string
+	sess    *clientSession
+	closed  bool
+	logger  LoggerInterface
+
+	// reconnecting is canceled once closed by user.
+	reconnectCtx  context.Context
+	stopReconnect context.CancelFunc
+}
+
+// clientSession is the state of one underlying connection of ClientConn, it is
+// replaced by a new one each time ClientConn reconnected.
+type clientSession struct {
+	rawConn  net.Conn
+	once     sync.Once
+	wg       sync.WaitGroup
+	sendQ    *priorityQueue[writeData]
+	handlerQ *priorityQueue[MessageHandler]
+	timing   *TimingWheel
+	calls    *callTable
+	cancel   context.CancelFunc
+	// following guarded by ClientConn.mu
+	ctx     context.Context
+	heart   int64
+	rtt     time.Duration
+	version uint32
+	pending []int64
 }
 
 // NewClientConn returns a new client connection which has not started to
 // serve requests yet.
 func NewClientConn(netid int64, c net.Conn, opt ...ServerOption) *ClientConn {
+	return newClientConnWithOptions(netid, c, newClientOptions(opt))
+}
+
+func newClientOptions(opt []ServerOption) options {
 	var opts options
 	for _, o := range opt {
 		o(&opts)
 	}
 	if opts.codec == nil {
-		opts.codec = TypeLengthValueCodec{}
+		opts.codec = TypeLengthValueCodec{Router: opts.router}
+	}
+	if opts.outboxSize > 0 {
+		// outbox is shared by all the connections reconnected.
+		opts.outbox = newOutbox(opts.outboxSize, opts.outboxTTL, opts.onExpire)
 	}
-	return newClientConnWithOptions(netid, c, opts)
+	return opts
 }
 
 func newClientConnWithOptions(netid int64, c net.Conn, opts options) *ClientConn {
 	cc := &ClientConn{
-		addr:      c.RemoteAddr().String(),
-		opts:      opts,
-		netid:     netid,
-		rawConn:   c,
-		once:      &sync.Once{},
-		wg:        &sync.WaitGroup{},
-		sendCh:    make(chan writeData, 1024),
-		handlerCh: make(chan MessageHandler, 1024),
-		heart:     time.Now().UnixNano(),
-	}
-	cc.ctx, cc.cancel = context.WithCancel(context.Background())
-	cc.timing = NewTimingWheel(cc.ctx)
-	cc.name = c.RemoteAddr().String()
-	cc.pending = []int64{}
+		network: c.RemoteAddr().Network(),
+		addr:    c.RemoteAddr().String(),
+		opts:    opts,
+		netid:   netid,
+		name:    c.RemoteAddr().String(),
+		sess:    newClientSession(c, opts),
+	}
+	if opts.reconnect {
+		ctx := opts.reconnectCtx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		cc.reconnectCtx, cc.stopReconnect = context.WithCancel(ctx)
+	}
 	return cc
 }
 
+func newClientSession(c net.Conn, opts options) *clientSession {
+	cfg := resolveConfig(opts)
+	s := &clientSession{
+		rawConn:  c,
+		sendQ:    newPriorityQueue[writeData](cfg.SendQueueSize, opts.scheduling),
+		handlerQ: newPriorityQueue[MessageHandler](cfg.HandlerQueueSize, opts.scheduling),
+		calls:    newCallTable(),
+		heart:    time.Now().UnixNano(),
+		pending:  []int64{},
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.timing = newTimingWheel(s.ctx, cfg.TimingWheelQueueSize)
+	return s
+}
+
+// session returns the current session of client connection.
+func (cc *ClientConn) session() *clientSession {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.sess
+}
+
+// context returns the current session and its context.
+func (cc *ClientConn) context() (*clientSession, context.Context) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.sess, cc.sess.ctx
+}
+
 // GetNetID returns the net ID of client connection.
 func (cc *ClientConn) GetNetID() int64 {
 	return cc.netid
@@ -351,59 +453,106 @@ func (cc *ClientConn) GetName() string {
 // SetHeartBeat sets the heart beats of client connection.
 func (cc *ClientConn) SetHeartBeat(heart int64) {
 	cc.mu.Lock()
-	cc.heart = heart
+	cc.sess.heart = heart
 	cc.mu.Unlock()
 }
 
 // GetHeartBeat gets the heart beats of client connection.
 func (cc *ClientConn) GetHeartBeat() int64 {
 	cc.mu.Lock()
-	heart := cc.heart
+	heart := cc.sess.heart
 	cc.mu.Unlock()
 	return heart
 }
 
+// Pending returns the number of messages waiting to be written.
+func (cc *ClientConn) Pending() int {
+	return cc.session().sendQ.Len()
+}
+
+func (cc *ClientConn) isClosed() bool {
+	_, ctx := cc.context()
+	return ctx.Err() != nil
+}
+
 // SetContextValue sets extra data to client connection.
 func (cc *ClientConn) SetContextValue(k, v interface{}) {
 	cc.mu.Lock()
 	defer cc.mu.Unlock()
-	cc.ctx = context.WithValue(cc.ctx, k, v)
+	cc.sess.ctx = context.WithValue(cc.sess.ctx, k, v)
 }
 
 // GetContextValue gets extra data from client connection.
 func (cc *ClientConn) GetContextValue(k interface{}) interface{} {
 	cc.mu.Lock()
 	defer cc.mu.Unlock()
-	return cc.ctx.Value(k)
+	return cc.sess.ctx.Value(k)
 }
 
 // Start starts the client connection, creating go-routines for reading,
 // writing and handlng.
 func (cc *ClientConn) Start() {
+	cc.start(cc.session())
+}
+
+func (cc *ClientConn) start(s *clientSession) {
 	if cc.logger != nil {
 		cc.logger.Infof("conn start, <%v -> %v>\n",
-			cc.rawConn.LocalAddr(), cc.rawConn.RemoteAddr())
+			s.rawConn.LocalAddr(), s.rawConn.RemoteAddr())
+	}
+	if err := cc.sendVersion(s); err != nil {
+		if cc.logger != nil {
+			cc.logger.Errorf("error sending version %v\n", err)
+		}
+		reportError(cc, ErrorHandshake, VersionMessageNumber, err)
 	}
 	onConnect := cc.opts.onConnect
 	if onConnect != nil {
 		onConnect(cc)
 	}
+	cc.startHeartBeat(s)
 
+	// the session may have been closed in onConnect, no go-routines to start
+	// then. Loops are added under cc.mu so that drop never misses them.
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return
+	}
 	loopers := []func(WriteCloser, *sync.WaitGroup){readLoop, writeLoop, handleLoop}
 	for _, l := range loopers {
 		looper := l
-		cc.wg.Add(1)
-		go looper(cc, cc.wg)
+		s.wg.Add(1)
+		go looper(cc, &s.wg)
 	}
 }
 
 // Close gracefully closes the client connection. It blocked until all sub
-// go-routines are completed and returned.
+// go-routines are completed and returned. A reconnectable client connection
+// stops reconnecting once closed by user.
 func (cc *ClientConn) Close() {
-	cc.once.Do(func() {
+	cc.mu.Lock()
+	cc.closed = true
+	s := cc.sess
+	cc.mu.Unlock()
+
+	if cc.stopReconnect != nil {
+		cc.stopReconnect()
+	}
+	cc.drop(s)
+	if ob := cc.opts.outbox; ob != nil {
+		// messages taken back from the session dropped are never sent
+		ob.close()
+	}
+}
+
+// drop closes session s of the client connection on errors, reconnecting
+// afterwards if enabled and not closed by user.
+func (cc *ClientConn) drop(s *clientSession) {
+	s.once.Do(func() {
 		if cc.logger != nil {
 			cc.logger.Infof("conn close gracefully, <%v -> %v>\n",
-				cc.rawConn.LocalAddr(), cc.rawConn.RemoteAddr())
+				s.rawConn.LocalAddr(), s.rawConn.RemoteAddr())
 		}
 
 		// callback on close
@@ -414,127 +563,160 @@ func (cc *ClientConn) Close() {
 
 		// close net.Conn, any blocked read or write operation will be unblocked and
 		// return errors.
-		cc.rawConn.Close()
+		s.rawConn.Close()
 
 		// cancel readLoop, writeLoop and handleLoop go-routines.
 		cc.mu.Lock()
-		cc.cancel()
-		cc.pending = nil
+		s.cancel()
+		s.pending = nil
+		closed := cc.closed
 		cc.mu.Unlock()
 
 		// stop timer
-		cc.timing.Stop()
+		s.timing.Stop()
 
 		// wait until all go-routines exited.
-		cc.wg.Wait()
+		s.wg.Wait()
+		s.calls.close()
 
 		// close all channels.
-		close(cc.sendCh)
-		close(cc.handlerCh)
-
-		// cc.once is a *sync.Once. After reconnect() returned, cc.once will point
-		// to a newly-allocated one while other go-routines such as readLoop,
-		// writeLoop and handleLoop blocking on the old *sync.Once continue to
-		// execute Close() (and of course do nothing because of sync.Once).
-		// NOTE that it will cause an "unlock of unlocked mutex" error if cc.once is
-		// a sync.Once struct, because "defer o.m.Unlock()" in sync.Once.Do() will
-		// be performed on an unlocked mutex(the newly-allocated one noticed above)
-		if cc.opts.reconnect {
-			cc.reconnect()
+		s.sendQ.close()
+		s.handlerQ.close()
+
+		if cc.opts.reconnect && !closed {
+			go cc.reconnect()
 		}
 	})
 }
 
-// reconnect reconnects and returns a new *ClientConn.
-func (cc *ClientConn) reconnect() {
-	var c net.Conn
-	var err error
-	if cc.opts.tlsCfg != nil {
-		c, err = tls.Dial("tcp", cc.addr, cc.opts.tlsCfg)
-		if err != nil {
-			if cc.logger != nil {
-				cc.logger.Criticalf("tls dial error", err)
-			}
-		}
-	} else {
-		c, err = net.Dial("tcp", cc.addr)
-		if err != nil {
-			if cc.logger != nil {
-				cc.logger.Criticalf("net dial error", err)
-			}
-		}
+// closeConn closes c on errors, ClientConn is dropped to reconnect if enabled.
+func closeConn(c WriteCloser) {
+	if cc, ok := c.(*ClientConn); ok {
+		cc.drop(cc.session())
+		return
 	}
-	// copy the newly-created *ClientConn to cc, so after
-	// reconnect returned cc will be updated to new one.
-	*cc = *newClientConnWithOptions(cc.netid, c, cc.opts)
-	cc.Start()
+	c.Close()
 }
 
 // Write writes a message to the client.
 func (cc *ClientConn) Write(message Message) error {
-	return asyncWrite(cc, message, nil)
+	return cc.WriteWithPriority(message, priorityOf(cc.opts.router, message))
+}
+
+// WriteWithPriority writes a message to the client at priority p instead of
+// the one declared for its message number.
+func (cc *ClientConn) WriteWithPriority(message Message, p Priority) error {
+	if ob := cc.opts.outbox; ob != nil {
+		return cc.writeOutbox(message, p, ob.ttl, nil)
+	}
+	return asyncWrite(cc, message, p, nil)
+}
+
+// WriteWithTTL writes a message to the client, the message is dropped if still
+// queued in outbox after ttl. It is the same as Write without OutboxOption.
+func (cc *ClientConn) WriteWithTTL(message Message, ttl time.Duration) error {
+	if ob := cc.opts.outbox; ob != nil {
+		return cc.writeOutbox(message, priorityOf(cc.opts.router, message), ttl, nil)
+	}
+	return asyncWrite(cc, message, priorityOf(cc.opts.router, message), nil)
+}
+
+// writeOutbox writes message through outbox, reporting failures to onError.
+func (cc *ClientConn) writeOutbox(message Message, p Priority, ttl time.Duration, cbRes chan bool) error {
+	err := cc.opts.outbox.write(cc.opts.codec, message, p, ttl, cbRes)
+	switch {
+	case err == ErrWouldBlock:
+		reportError(cc, ErrorOverflow, messageNumber(message), err)
+	case err != nil && err != ErrConnClosed:
+		reportError(cc, ErrorEncode, messageNumber(message), err)
+	}
+	return err
 }
 
 func (cc *ClientConn) WriteByRes(message Message) error {
 	resChan := make(chan bool, 1)
-	err := asyncWrite(cc, message, resChan)
-	if err != nil{
+	var err error
+	if ob := cc.opts.outbox; ob != nil {
+		err = cc.writeOutbox(message, priorityOf(cc.opts.router, message), ob.ttl, resChan)
+	} else {
+		err = asyncWrite(cc, message, priorityOf(cc.opts.router, message), resChan)
+	}
+	if err != nil {
 		return err
 	}
 
-	<-resChan
+	if sent := <-resChan; !sent {
+		// dropped by outbox
+		if cc.opts.outbox.isClosed() {
+			return ErrConnClosed
+		}
+		return ErrMessageExpired
+	}
 	return nil
 }
 
 // RunAt runs a callback at the specified timestamp.
 func (cc *ClientConn) RunAt(timestamp time.Time, callback func(time.Time, WriteCloser)) int64 {
-	id := runAt(cc.ctx, cc.netid, cc.timing, timestamp, callback)
+	s, ctx := cc.context()
+	id := runAt(ctx, cc.netid, s.timing, timestamp, callback)
 	if id >= 0 {
-		cc.AddPendingTimer(id)
+		cc.addPendingTimer(s, id)
 	}
 	return id
 }
 
 // RunAfter runs a callback right after the specified duration ellapsed.
 func (cc *ClientConn) RunAfter(duration time.Duration, callback func(time.Time, WriteCloser)) int64 {
-	id := runAfter(cc.ctx, cc.netid, cc.timing, duration, callback)
+	s, ctx := cc.context()
+	id := runAfter(ctx, cc.netid, s.timing, duration, callback)
 	if id >= 0 {
-		cc.AddPendingTimer(id)
+		cc.addPendingTimer(s, id)
 	}
 	return id
 }
 
 // RunEvery runs a callback on every interval time.
 func (cc *ClientConn) RunEvery(interval time.Duration, callback func(time.Time, WriteCloser)) int64 {
-	id := runEvery(cc.ctx, cc.netid, cc.timing, interval, callback)
+	return cc.runEvery(cc.session(), interval, callback)
+}
+
+func (cc *ClientConn) runEvery(s *clientSession, interval time.Duration, callback func(time.Time, WriteCloser)) int64 {
+	cc.mu.Lock()
+	ctx := s.ctx
+	cc.mu.Unlock()
+	id := runEvery(ctx, cc.netid, s.timing, interval, callback)
 	if id >= 0 {
-		cc.AddPendingTimer(id)
+		cc.addPendingTimer(s, id)
 	}
 	return id
 }
 
 // AddPendingTimer adds a new timer ID to client connection.
 func (cc *ClientConn) AddPendingTimer(timerID int64) {
+	cc.addPendingTimer(cc.session(), timerID)
+}
+
+func (cc *ClientConn) addPendingTimer(s *clientSession, timerID int64) {
 	cc.mu.Lock()
 	defer cc.mu.Unlock()
-	if cc.pending != nil {
-		cc.pending = append(cc.pending, timerID)
+	if s.pending != nil {
+		s.pending = append(s.pending, timerID)
 	}
 }
 
 // CancelTimer cancels a timer with the specified ID.
 func (cc *ClientConn) CancelTimer(timerID int64) {
-	cancelTimer(cc.timing, timerID)
+	cancelTimer(cc.session().timing, timerID)
 }
 
 // RemoteAddr returns the remote address of server connection.
 func (cc *ClientConn) RemoteAddr() net.Addr {
-	return cc.rawConn.RemoteAddr()
+	return cc.session().rawConn.RemoteAddr()
 }
 
 // LocalAddr returns the local address of server connection.
 func (cc *ClientConn) LocalAddr() net.Addr {
-	return cc.rawConn.LocalAddr()
+	return cc.session().rawConn.LocalAddr()
 }
 
 func runAt(ctx context.Context, netID int64, timing *TimingWheel, ts time.Time, cb func(time.Time, WriteCloser)) int64 {
@@ -553,7 +735,7 @@ func runEvery(ctx context.Context, netID int64, timing *TimingWheel, d time.Dura
 	return timing.AddTimer(delay, d, timeout)
 }
 
-func asyncWrite(c interface{}, m Message, cd chan bool) error {
+func asyncWrite(c interface{}, m Message, p Priority, cd chan bool) error {
 	defer func() error {
 		if p := recover(); p != nil {
 			return ErrServerClosed
@@ -562,37 +744,38 @@ func asyncWrite(c interface{}, m Message, cd chan bool) error {
 	}()
 
 	var (
-		pkt    []byte
-		err    error
-		sendCh chan writeData
+		pkt   []byte
+		err   error
+		sendQ *priorityQueue[writeData]
 	)
 	switch c := c.(type) {
 	case *ServerConn:
 		pkt, err = c.belong.opts.codec.Encode(m)
-		sendCh = c.sendCh
+		sendQ = c.sendQ
 
 	case *ClientConn:
 		pkt, err = c.opts.codec.Encode(m)
-		sendCh = c.sendCh
+		sendQ = c.session().sendQ
 	}
 
 	if err != nil {
+		reportError(c.(WriteCloser), ErrorEncode, messageNumber(m), err)
 		return err
 	}
 
-	select {
-	case sendCh <- writeData{
-		data:pkt,
-		cbRes:cd,
-	}:
-		return nil
-	default:
+	if !sendQ.tryPush(p, writeData{
+		data:  pkt,
+		cbRes: cd,
+		msg:   m,
+	}) {
+		reportError(c.(WriteCloser), ErrorOverflow, messageNumber(m), ErrWouldBlock)
 		return ErrWouldBlock
 	}
+	return nil
 }
 
-/* readLoop() blocking read from connection, deserialize bytes into message,
-then find corresponding handler, put it into channel */
+// readLoop() blocking read from connection, deserialize bytes into message,
+// then find corresponding handler, put it into channel
 func readLoop(c WriteCloser, wg *sync.WaitGroup) {
 	var (
 		rawConn          net.Conn
@@ -601,10 +784,20 @@ func readLoop(c WriteCloser, wg *sync.WaitGroup) {
 		sDone            <-chan struct{}
 		setHeartBeatFunc func(int64)
 		onMessage        onMessageFunc
-		handlerCh        chan MessageHandler
+		router           *Router
+		handlerQ         *priorityQueue[MessageHandler]
+		onHeartBeat      func(HeartBeatMessage) bool
+		onResponse       func(Message) bool
+		onVersion        func(vm VersionMessage, first bool) (uint32, error)
+		version          uint32
+		first            = true
+		limiter          *connLimiter
+		policy           RateLimitPolicy
+		readTimeout      time.Duration
 		msg              Message
 		err              error
-		logger LoggerInterface
+		logger           LoggerInterface
+		drop             func()
 	)
 
 	switch c := c.(type) {
@@ -615,26 +808,73 @@ func readLoop(c WriteCloser, wg *sync.WaitGroup) {
 		sDone = c.belong.ctx.Done()
 		setHeartBeatFunc = c.SetHeartBeat
 		onMessage = c.belong.opts.onMessage
-		handlerCh = c.handlerCh
+		router = routerOf(c.belong.opts.router)
+		handlerQ = c.handlerQ
+		limiter = c.limiter
+		policy = c.belong.opts.rateLimitPolicy
+		readTimeout = c.belong.opts.readTimeout
 		logger = c.logger
+		onVersion = func(vm VersionMessage, first bool) (uint32, error) {
+			// clients negotiate once by their first frame
+			if !first {
+				return 0, ErrUnexpectedVersion
+			}
+			v := negotiateVersion(c.belong.opts.version, vm.Version)
+			c.setVersion(v)
+			c.Write(VersionMessage{Version: v})
+			return v, nil
+		}
+		if c.belong.opts.heartbeatEnabled() {
+			onHeartBeat = func(hb HeartBeatMessage) bool {
+				// echo back for measuring round-trip time on client
+				c.Write(hb)
+				return true
+			}
+		}
+		drop = c.Close
 	case *ClientConn:
-		rawConn = c.rawConn
+		s, ctx := c.context()
+		rawConn = s.rawConn
 		codec = c.opts.codec
-		cDone = c.ctx.Done()
+		cDone = ctx.Done()
 		sDone = nil
 		setHeartBeatFunc = c.SetHeartBeat
 		onMessage = c.opts.onMessage
-		handlerCh = c.handlerCh
+		router = routerOf(c.opts.router)
+		handlerQ = s.handlerQ
+		onResponse = s.calls.deliver
+		negotiated := c.opts.version == 0
+		onVersion = func(vm VersionMessage, _ bool) (uint32, error) {
+			// the server answers once, and only if asked
+			if negotiated {
+				return 0, ErrUnexpectedVersion
+			}
+			negotiated = true
+			c.setVersion(vm.Version)
+			return vm.Version, nil
+		}
+		readTimeout = c.opts.readTimeout
+		if c.opts.heartbeatEnabled() {
+			onHeartBeat = func(hb HeartBeatMessage) bool {
+				c.setRTT(time.Since(time.Unix(0, hb.Timestamp)))
+				return true
+			}
+		}
+		drop = func() { c.drop(s) }
 	}
 
 	defer func() {
 		if p := recover(); p != nil {
+			if _, ok := p.(fatalPanic); ok {
+				panic(p)
+			}
 			if logger != nil {
 				logger.Errorf("panics: %v\n", p)
 			}
+			reportError(c, ErrorPanic, messageNumber(msg), fmt.Errorf("panic: %v", p))
 		}
 		wg.Done()
-		c.Close()
+		drop()
 	}()
 
 	for {
@@ -650,26 +890,92 @@ func readLoop(c WriteCloser, wg *sync.WaitGroup) {
 			}
 			return
 		default:
-			msg, err = codec.Decode(rawConn)
+			if readTimeout > 0 {
+				rawConn.SetReadDeadline(time.Now().Add(readTimeout))
+			}
+			if vc, ok := codec.(VersionedCodec); ok && version != 0 {
+				msg, err = vc.DecodeVersion(rawConn, version)
+			} else {
+				msg, err = codec.Decode(rawConn)
+			}
 			if err != nil {
 				if logger != nil {
 					logger.Errorf("error decoding message %v\n", err)
 				}
-				if _, ok := err.(ErrUndefined); ok {
+				if e, ok := err.(ErrUndefined); ok {
+					reportError(c, ErrorDecode, int32(e), err)
 					// update heart beats
 					setHeartBeatFunc(time.Now().UnixNano())
+					first = false
 					continue
 				}
+				select {
+				case <-cDone: // closed by ourselves, nothing to report
+				default:
+					if isTimeout(err) {
+						reportError(c, ErrorTimeout, noMessage, ErrTimeout{Op: "read", Err: err})
+					} else if err != io.EOF {
+						reportError(c, ErrorDecode, noMessage, err)
+					}
+				}
 				return
 			}
 			setHeartBeatFunc(time.Now().UnixNano())
-			handler := GetHandlerFunc(msg.MessageNumber())
+			isFirst := first
+			first = false
+			// every frame decoded is charged, heart beats and responses too
+			if limiter != nil {
+				delay, err := limiter.take(msg.MessageNumber(), policy == RateLimitDelay)
+				if err != nil {
+					if logger != nil {
+						logger.Warnf("%v\n", err)
+					}
+					reportError(c, ErrorRateLimited, msg.MessageNumber(), err)
+					if delay == 0 {
+						if policy == RateLimitDisconnect {
+							return
+						}
+						continue
+					}
+				}
+				if delay > 0 {
+					// tokens reserved under RateLimitDelay, stop reading until
+					// they are refilled.
+					select {
+					case <-time.After(delay):
+					case <-cDone:
+						return
+					case <-sDone:
+						return
+					}
+				}
+			}
+			if vm, ok := msg.(VersionMessage); ok {
+				if version, err = onVersion(vm, isFirst); err != nil {
+					if logger != nil {
+						logger.Errorf("error negotiating version %v\n", err)
+					}
+					reportError(c, ErrorHandshake, VersionMessageNumber, err)
+					return
+				}
+				continue
+			}
+			if hb, ok := msg.(HeartBeatMessage); ok && onHeartBeat != nil && onHeartBeat(hb) {
+				continue
+			}
+			if onResponse != nil && onResponse(msg) {
+				continue
+			}
+			handler := router.handleFunc(msg.MessageNumber())
 			if handler == nil {
 				if onMessage != nil {
 					if logger != nil {
 						logger.Infof("message %d call onMessage()\n", msg.MessageNumber())
 					}
-					onMessage(msg, c.(WriteCloser))
+					func() {
+						defer recoverCallback(c, msg.MessageNumber())
+						onMessage(msg, c.(WriteCloser))
+					}()
 				} else {
 					if logger != nil {
 						logger.Warnf("no handler or onMessage() found for message %d\n",
@@ -678,98 +984,144 @@ func readLoop(c WriteCloser, wg *sync.WaitGroup) {
 				}
 				continue
 			}
-			handlerCh <- MessageHandler{msg, handler}
+			p := router.Priority(msg.MessageNumber())
+			if !handlerQ.tryPush(p, MessageHandler{msg, handler}) {
+				// handlers are falling behind, block reading so that flow
+				// control of the transport pushes back on peer.
+				addTotalSaturated()
+				if !handlerQ.push(p, MessageHandler{msg, handler}, cDone, sDone) {
+					return
+				}
+			}
 		}
 	}
 }
 
 type writeData struct {
-	data []byte
-	cbRes chan bool
+	data   []byte
+	cbRes  chan bool
+	msg    Message // for outbox and error reporting
+	frame  *frame  // shared by broadcast, released after written
+	expire int64   // in unix nanoseconds, for outbox use only
 }
 
-/* writeLoop() receive message from channel, serialize it into bytes,
-then blocking write into connection */
+// writeLoop() receive message from channel, serialize it into bytes,
+// then blocking write into connection
 func writeLoop(c WriteCloser, wg *sync.WaitGroup) {
 	var (
 		rawConn net.Conn
-		sendCh  chan writeData
+		sendQ   *priorityQueue[writeData]
 		cDone   <-chan struct{}
 		sDone   <-chan struct{}
+		ob      *outbox
+		failed  *writeData
+		timeout time.Duration
 		err     error
-		logger LoggerInterface
+		logger  LoggerInterface
+		drop    func()
 	)
 
 	switch c := c.(type) {
 	case *ServerConn:
 		rawConn = c.rawConn
-		sendCh = c.sendCh
+		sendQ = c.sendQ
 		cDone = c.ctx.Done()
 		sDone = c.belong.ctx.Done()
+		timeout = c.belong.opts.writeTimeout
 		logger = c.logger
+		drop = c.Close
 	case *ClientConn:
-		rawConn = c.rawConn
-		sendCh = c.sendCh
-		cDone = c.ctx.Done()
+		s, ctx := c.context()
+		rawConn = s.rawConn
+		sendQ = s.sendQ
+		cDone = ctx.Done()
 		sDone = nil
+		ob = c.opts.outbox
+		timeout = c.opts.writeTimeout
+		drop = func() { c.drop(s) }
+	}
+
+	write := func(pkt writeData) error {
+		if timeout > 0 {
+			rawConn.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		_, err := rawConn.Write(pkt.data)
+		pkt.frame.release()
+		if err != nil {
+			if isTimeout(err) {
+				err = ErrTimeout{Op: "write", Err: err}
+				reportError(c, ErrorTimeout, messageNumber(pkt.msg), err)
+			} else {
+				reportError(c, ErrorWrite, messageNumber(pkt.msg), err)
+			}
+		}
+		return err
 	}
 
 	defer func() {
 		if p := recover(); p != nil {
-			if logger!= nil {
+			if logger != nil {
 				logger.Errorf("panics: %v\n", p)
 			}
+			reportError(c, ErrorPanic, noMessage, fmt.Errorf("panic: %v", p))
 		}
-		// drain all pending messages before exit
-	OuterFor:
-		for {
-			select {
-			case pkt := <-sendCh:
-				if pkt.data != nil {
-					if _, err = rawConn.Write(pkt.data); err != nil {
-						if logger!= nil {
-							logger.Errorf("error writing data %v\n", err)
-						}
-					}else{
-						if pkt.cbRes != nil{
-							pkt.cbRes <- true
-						}
+		// keep pending messages in outbox for the reconnected one, or drain
+		// all of them before exit
+		if ob != nil {
+			ob.detach(sendQ, failed)
+		}
+		for ob == nil {
+			pkt, ok := sendQ.tryPop()
+			if !ok {
+				break
+			}
+			if pkt.data != nil {
+				if err = write(pkt); err != nil {
+					if logger != nil {
+						logger.Errorf("error writing data %v\n", err)
+					}
+				} else {
+					if pkt.cbRes != nil {
+						pkt.cbRes <- true
 					}
 				}
-			default:
-				break OuterFor
 			}
 		}
 		wg.Done()
 		if logger != nil {
 			logger.Debug("writeLoop go-routine exited")
 		}
-		c.Close()
+		drop()
 	}()
 
-	for {
-		select {
-		case <-cDone: // connection closed
+	if ob != nil {
+		// replay messages queued while disconnected before any others.
+		if err = ob.replay(write, sendQ); err != nil {
 			if logger != nil {
-				logger.Debug("receiving cancel signal from conn")
+				logger.Errorf("error replaying outbox %v\n", err)
 			}
 			return
-		case <-sDone: // server closed
+		}
+	}
+
+	for {
+		pkt, ok := sendQ.pop(cDone, sDone)
+		if !ok { // connection or server closed
 			if logger != nil {
-				logger.Debug("receiving cancel signal from server")
+				logger.Debug("receiving cancel signal")
 			}
 			return
-		case pkt := <-sendCh:
-			if pkt.data != nil {
-				if _, err = rawConn.Write(pkt.data); err != nil {
-					if logger != nil {
-						logger.Errorf("error writing data %v\n", err)
-					}
-					return
-				}else{
-					if pkt.cbRes != nil{
-						pkt.cbRes <- true
-					}
+		}
+		if pkt.data != nil {
+			if err = write(pkt); err != nil {
+				if logger != nil {
+					logger.Errorf("error writing data %v\n", err)
+				}
+				failed = &pkt
+				return
+			} else {
+				if pkt.cbRes != nil {
+					pkt.cbRes <- true
 				}
 			}
 		}
@@ -782,11 +1134,17 @@ func handleLoop(c WriteCloser, wg *sync.WaitGroup) {
 		cDone        <-chan struct{}
 		sDone        <-chan struct{}
 		timerCh      chan *OnTimeOut
-		handlerCh    chan MessageHandler
+		handlerQ     *priorityQueue[MessageHandler]
 		netID        int64
 		ctx          context.Context
 		askForWorker bool
-		logger LoggerInterface
+		workers      *WorkerPool
+		getPrincipal func() *Principal
+		onDenied     onDeniedFunc
+		router       *Router
+		msg          Message
+		logger       LoggerInterface
+		drop         func()
 	)
 
 	switch c := c.(type) {
@@ -794,31 +1152,45 @@ func handleLoop(c WriteCloser, wg *sync.WaitGroup) {
 		cDone = c.ctx.Done()
 		sDone = c.belong.ctx.Done()
 		timerCh = c.timerCh
-		handlerCh = c.handlerCh
+		handlerQ = c.handlerQ
 		netID = c.netid
 		ctx = c.ctx
 		askForWorker = true
+		workers = c.belong.workers
+		getPrincipal = c.GetPrincipal
+		onDenied = c.belong.opts.onDenied
+		router = routerOf(c.belong.opts.router)
 		logger = c.logger
+		drop = c.Close
 	case *ClientConn:
-		cDone = c.ctx.Done()
+		var s *clientSession
+		s, ctx = c.context()
+		cDone = ctx.Done()
 		sDone = nil
-		timerCh = c.timing.timeOutChan
-		handlerCh = c.handlerCh
+		timerCh = s.timing.timeOutChan
+		handlerQ = s.handlerQ
 		netID = c.netid
-		ctx = c.ctx
+		getPrincipal = c.GetPrincipal
+		onDenied = c.opts.onDenied
+		router = routerOf(c.opts.router)
+		drop = func() { c.drop(s) }
 	}
 
 	defer func() {
 		if p := recover(); p != nil {
+			if _, ok := p.(fatalPanic); ok {
+				panic(p)
+			}
 			if logger != nil {
 				logger.Errorf("panics: %v\n", p)
 			}
+			reportError(c, ErrorPanic, messageNumber(msg), fmt.Errorf("panic: %v", p))
 		}
 		wg.Done()
 		if logger != nil {
 			logger.Debug("handleLoop go-routine exited")
 		}
-		c.Close()
+		drop()
 	}()
 
 	for {
@@ -833,16 +1205,54 @@ func handleLoop(c WriteCloser, wg *sync.WaitGroup) {
 				logger.Debug("receiving cancel signal from server")
 			}
 			return
-		case msgHandler := <-handlerCh:
-			msg, handler := msgHandler.message, msgHandler.handler
+		case <-handlerQ.wait():
+			msgHandler, ok := handlerQ.tryPop()
+			if !ok {
+				continue
+			}
+			var handler handleFunc
+			msg, handler = msgHandler.message, msgHandler.handler
+			// check ACL against the principal before queuing the handler
+			if acl := router.ACL(msg.MessageNumber()); acl != nil {
+				principal := getPrincipal()
+				if !acl.Allow(principal) {
+					addTotalDenied()
+					if logger != nil {
+						logger.Warnf("message %d denied on net %d\n", msg.MessageNumber(), netID)
+					}
+					if onDenied != nil {
+						if reply := onDenied(msg, principal); reply != nil {
+							c.Write(reply)
+						}
+					}
+					continue
+				}
+			}
 			if handler != nil {
 				if askForWorker {
-					WorkerPoolInstance().Put(netID, func() {
-						handler(NewContextWithNetID(NewContextWithMessage(ctx, msg), netID), c)
+					// wait for the worker rather than dropping the message, so
+					// handlerQ fills up and readLoop stops reading from peer.
+					m := msg
+					err := workers.PutWait(ctx, netID, func() {
+						defer recoverCallback(c, m.MessageNumber())
+						if err := handler(NewContextWithNetID(NewContextWithMessage(ctx, m), netID), c); err != nil {
+							replyError(c, m, err)
+						}
 					})
+					if err != nil {
+						if logger != nil {
+							logger.Debugf("message %d not handled %v\n", m.MessageNumber(), err)
+						}
+						return
+					}
 					addTotalHandle()
 				} else {
-					handler(NewContextWithNetID(NewContextWithMessage(ctx, msg), netID), c)
+					func() {
+						defer recoverCallback(c, msg.MessageNumber())
+						if err := handler(NewContextWithNetID(NewContextWithMessage(ctx, msg), netID), c); err != nil {
+							replyError(c, msg, err)
+						}
+					}()
 				}
 			}
 		case timeout := <-timerCh:
@@ -855,11 +1265,18 @@ func handleLoop(c WriteCloser, wg *sync.WaitGroup) {
 					}
 				}
 				if askForWorker {
-					WorkerPoolInstance().Put(netID, func() {
+					err := workers.Put(netID, func() {
+						defer recoverCallback(c, noMessage)
 						timeout.Callback(time.Now(), c.(WriteCloser))
 					})
+					if err != nil {
+						reportError(c, ErrorOverflow, noMessage, err)
+					}
 				} else {
-					timeout.Callback(time.Now(), c.(WriteCloser))
+					func() {
+						defer recoverCallback(c, noMessage)
+						timeout.Callback(time.Now(), c.(WriteCloser))
+					}()
 				}
 			}
 		}
@@ -0,0 +1,113 @@
+package tao
+
+import (
+	"fmt"
+)
+
+// ErrorKind tells where an error reported to OnConnErrorOption comes from.
+type ErrorKind int
+
+// Kinds of ConnError.
+const (
+	// ErrorDecode means a message could not be read or decoded.
+	ErrorDecode ErrorKind = iota
+	// ErrorEncode means a message could not be encoded.
+	ErrorEncode
+	// ErrorWrite means encoded data could not be written to peer.
+	ErrorWrite
+	// ErrorPanic means a panic recovered in connection go-routines.
+	ErrorPanic
+	// ErrorOverflow means a queue was full and a message or handler dropped.
+	ErrorOverflow
+	// ErrorTimeout means a read, write or handshake deadline exceeded.
+	ErrorTimeout
+	// ErrorRateLimited means a message exceeded its rate limit.
+	ErrorRateLimited
+	// ErrorHandshake means TLS handshake or version negotiation failed.
+	ErrorHandshake
+	// ErrorHandler means a handler returned an error.
+	ErrorHandler
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorDecode:
+		return "decode"
+	case ErrorEncode:
+		return "encode"
+	case ErrorWrite:
+		return "write"
+	case ErrorPanic:
+		return "panic"
+	case ErrorOverflow:
+		return "overflow"
+	case ErrorTimeout:
+		return "timeout"
+	case ErrorRateLimited:
+		return "rate limited"
+	case ErrorHandshake:
+		return "handshake"
+	case ErrorHandler:
+		return "handler"
+	}
+	return "unknown"
+}
+
+// noMessage is the message number of ConnError not related to any message.
+const noMessage = -1
+
+// ConnError is the error passed to the callback set by OnConnErrorOption.
+type ConnError struct {
+	Kind ErrorKind
+	// MessageNumber is the number of message involved, -1 if none.
+	MessageNumber int32
+	Err           error
+}
+
+func (e *ConnError) Error() string {
+	if e.MessageNumber == noMessage {
+		return fmt.Sprintf("%v error: %v", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%v error on message %d: %v", e.Kind, e.MessageNumber, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ConnError) Unwrap() error {
+	return e.Err
+}
+
+// reportError passes err to the onError callback of c if there is one. The
+// callback runs on a worker keyed by net ID of c, as its handlers do, instead
+// of the reporting go-routine, so errors of c are reported in order with its
+// messages handled and the callback is free to close c.
+func reportError(c WriteCloser, kind ErrorKind, msgType int32, err error) {
+	var (
+		onError onErrorFunc
+		workers *WorkerPool
+	)
+	switch c := c.(type) {
+	case *ServerConn:
+		onError = c.belong.opts.onError
+		workers = c.belong.workers
+	case *ClientConn:
+		onError = c.opts.onError
+		workers = WorkerPoolInstance()
+	}
+	if onError == nil {
+		return
+	}
+	ce := &ConnError{Kind: kind, MessageNumber: msgType, Err: err}
+	cb := func() { onError(c, ce) }
+	if workers == nil || workers.Put(c.GetNetID(), cb) != nil {
+		// pool saturated or closed
+		go cb()
+	}
+}
+
+// messageNumber returns the number of msg, or -1 if msg is nil.
+func messageNumber(msg Message) int32 {
+	if msg == nil {
+		return noMessage
+	}
+	return msg.MessageNumber()
+}
@@ -0,0 +1,123 @@
+package tao
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// undefinedFrame returns a frame of message number not registered.
+func undefinedFrame(msgType int32) []byte {
+	frame := binary.LittleEndian.AppendUint32(nil, uint32(msgType))
+	return binary.LittleEndian.AppendUint32(frame, 0)
+}
+
+func TestOnErrorCloses(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	closed := make(chan struct{})
+	cc := NewClientConn(1, client, OnConnErrorOption(func(c WriteCloser, err *ConnError) {
+		if err.Kind == ErrorDecode {
+			c.Close()
+			close(closed)
+		}
+	}))
+	cc.Start()
+
+	go server.Write(undefinedFrame(12345))
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close called by onError blocked")
+	}
+	if !cc.isClosed() {
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestOnErrorInOrder(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	const n = 20
+	got := make(chan int32, n)
+	cc := NewClientConn(1, client, OnConnErrorOption(func(c WriteCloser, err *ConnError) {
+		got <- err.MessageNumber
+	}))
+	defer cc.Close()
+	cc.Start()
+
+	go func() {
+		for i := int32(0); i < n; i++ {
+			server.Write(undefinedFrame(10000 + i))
+		}
+	}()
+	for i := int32(0); i < n; i++ {
+		select {
+		case msgType := <-got:
+			if msgType != 10000+i {
+				t.Fatalf("error of message %d reported, want %d", msgType, 10000+i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("error %d not reported", i)
+		}
+	}
+}
+
+func TestOnErrorAfterHandled(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	r := NewRouter()
+	Handle(r, textMessageNumber, func(_ context.Context, m *textMessage, _ WriteCloser) error {
+		close(started)
+		<-release
+		return nil
+	})
+	reported := make(chan struct{})
+	_, addr := startServer(t, RouterOption(r), OnConnErrorOption(func(_ WriteCloser, err *ConnError) {
+		if err.Kind == ErrorDecode {
+			close(reported)
+		}
+	}))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	writeFrame(t, conn, &textMessage{Text: "slow"})
+	<-started
+	conn.Write(undefinedFrame(12345))
+	// errors wait for the handler of the same connection
+	select {
+	case <-reported:
+		t.Fatal("error reported before the message ahead handled")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Fatal("error not reported")
+	}
+}
+
+func TestOnErrorOption(t *testing.T) {
+	reported := make(chan WriteCloser, 1)
+	s, addr := startServer(t, OnErrorOption(func(c WriteCloser) { reported <- c }))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write(undefinedFrame(12345))
+	select {
+	case c := <-reported:
+		if sc, ok := s.GetConn(c.GetNetID()); !ok || sc != c {
+			t.Fatalf("reported %v, want the connection", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("error not reported")
+	}
+}
@@ -0,0 +1,76 @@
+package tao
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrTimeout is reported to OnConnErrorOption when an operation on connection
+// does not complete within the configured timeout.
+type ErrTimeout struct {
+	Op  string // "read", "write" or "handshake"
+	Err error
+}
+
+func (e ErrTimeout) Error() string {
+	return fmt.Sprintf("%s timeout: %v", e.Op, e.Err)
+}
+
+// Timeout tells it is a timeout error.
+func (e ErrTimeout) Timeout() bool {
+	return true
+}
+
+// Unwrap returns the underlying error.
+func (e ErrTimeout) Unwrap() error {
+	return e.Err
+}
+
+// ReadTimeoutOption returns a ServerOption that closes the connection if no
+// data is read from peer within timeout.
+func ReadTimeoutOption(timeout time.Duration) ServerOption {
+	return func(o *options) {
+		o.readTimeout = timeout
+	}
+}
+
+// WriteTimeoutOption returns a ServerOption that closes the connection if a
+// message can not be written to peer within timeout.
+func WriteTimeoutOption(timeout time.Duration) ServerOption {
+	return func(o *options) {
+		o.writeTimeout = timeout
+	}
+}
+
+// HandshakeTimeoutOption returns a ServerOption that limits the time of reading
+// PROXY protocol header and performing TLS and custom handshakes.
+func HandshakeTimeoutOption(timeout time.Duration) ServerOption {
+	return func(o *options) {
+		o.handshakeTimeout = timeout
+	}
+}
+
+// isTimeout tells whether err is caused by deadline exceeded.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// handshake performs TLS handshake of server connection within the timeout,
+// so that a silent peer can not hold it forever.
+func (sc *ServerConn) handshake() error {
+	tc, ok := sc.rawConn.(*tls.Conn)
+	timeout := sc.belong.opts.handshakeTimeout
+	if !ok || timeout <= 0 {
+		return nil
+	}
+	tc.SetDeadline(time.Now().Add(timeout))
+	defer tc.SetDeadline(time.Time{})
+	err := tc.Handshake()
+	if err != nil && isTimeout(err) {
+		err = ErrTimeout{Op: "handshake", Err: err}
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package tao
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// timeoutErrors returns a ServerOption reporting timeouts to the channel
+// returned.
+func timeoutErrors() (ServerOption, <-chan *ConnError) {
+	errs := make(chan *ConnError, 1)
+	return OnConnErrorOption(func(_ WriteCloser, err *ConnError) {
+		if err.Kind == ErrorTimeout {
+			errs <- err
+		}
+	}), errs
+}
+
+// expectTimeout waits for a timeout of op reported.
+func expectTimeout(t *testing.T, errs <-chan *ConnError, op string) {
+	t.Helper()
+	select {
+	case err := <-errs:
+		var te ErrTimeout
+		if !errors.As(err, &te) || te.Op != op {
+			t.Fatalf("got %v, want %s timeout", err, op)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%s timeout not reported", op)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	onError, errs := timeoutErrors()
+	_, addr := startServer(t, ReadTimeoutOption(50*time.Millisecond), onError)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// active for a while, then idle
+	for i := 0; i < 4; i++ {
+		writeFrame(t, conn, HeartBeatMessage{Timestamp: int64(i)})
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("active peer got %v", err)
+	default:
+	}
+
+	expectTimeout(t, errs, "read")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("idle peer got %v, want connection closed", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	onError, errs := timeoutErrors()
+	closed := make(chan struct{})
+	client, server := net.Pipe()
+	defer server.Close()
+	cc := NewClientConn(0, client, WriteTimeoutOption(20*time.Millisecond), onError,
+		OnCloseOption(func(WriteCloser) { close(closed) }))
+	defer cc.Close()
+	cc.Start()
+
+	// peer never reads
+	cc.Write(outboxMessage(0))
+	expectTimeout(t, errs, "write")
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed after write timeout")
+	}
+}
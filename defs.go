@@ -30,19 +30,36 @@ var (
 	ErrBadData       = errors.New("more than 8M data")
 	ErrNotRegistered = errors.New("handler not registered")
 	ErrServerClosed  = errors.New("server has been closed")
+
+	ErrConnDenied        = errors.New("connection denied")
+	ErrTooManyConns      = errors.New("too many connections")
+	ErrAcceptRateLimited = errors.New("accept rate limited")
+	ErrBadProxyHeader    = errors.New("invalid PROXY protocol header")
+	ErrNoConn            = errors.New("no connection available")
+	ErrInvalidTopic      = errors.New("invalid topic")
+	ErrGroupExists       = errors.New("group already exists")
+	ErrGroupFull         = errors.New("group is full")
+	ErrGroupClosed       = errors.New("group has been removed")
+	ErrConnClosed        = errors.New("connection has been closed")
+	ErrConnNotFound      = errors.New("connection not found")
+	ErrUnexpectedVersion = errors.New("unexpected version message")
+	ErrMessageExpired    = errors.New("message expired in outbox")
 )
 
 const (
-	// WorkersNum is the number of worker go-routines.
+	// WorkersNum is the default minimum number of worker go-routines.
 	WorkersNum = 20
-	// MaxConnections is the maximum number of client connections allowed.
+	// MaxWorkersNum is the default maximum number of worker go-routines.
+	MaxWorkersNum = 200
+	// MaxConnections is the default maximum number of client connections allowed.
 	MaxConnections = 10000
 )
 
 type onConnectFunc func(WriteCloser) bool
 type onMessageFunc func(Message, WriteCloser)
 type onCloseFunc func(WriteCloser)
-type onErrorFunc func(WriteCloser)
+type onErrorFunc func(WriteCloser, *ConnError)
+type onDeniedFunc func(Message, *Principal) Message
 
 type workerFunc func()
 type onScheduleFunc func(time.Time, WriteCloser)
@@ -133,7 +150,12 @@ func isNil(v interface{}) bool {
 }
 
 func printStack() {
+	os.Stderr.Write(stackTrace())
+}
+
+// stackTrace returns the stack of current go-routine.
+func stackTrace() []byte {
 	var buf [4096]byte
 	n := runtime.Stack(buf[:], false)
-	os.Stderr.Write(buf[:n])
+	return buf[:n]
 }
@@ -0,0 +1,121 @@
+package tao
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// DialTimeoutOption returns a ServerOption that limits the time of dialing,
+// including TLS and custom handshakes.
+func DialTimeoutOption(timeout time.Duration) ServerOption {
+	return func(o *options) {
+		o.dialTimeout = timeout
+	}
+}
+
+// LocalAddrOption returns a ServerOption that binds the local address when
+// dialing.
+func LocalAddrOption(addr net.Addr) ServerOption {
+	return func(o *options) {
+		o.localAddr = addr
+	}
+}
+
+// KeepAliveOption returns a ServerOption that sets the TCP keep-alive period
+// when dialing, negative means disabled.
+func KeepAliveOption(period time.Duration) ServerOption {
+	return func(o *options) {
+		o.keepAlive = period
+	}
+}
+
+// TLSServerNameOption returns a ServerOption that sets the server name to
+// verify when dialing with TLS, it defaults to the host part of address.
+func TLSServerNameOption(name string) ServerOption {
+	return func(o *options) {
+		o.serverName = name
+	}
+}
+
+// DialerOption returns a ServerOption that replaces the dialer, it is used for
+// both dialing and reconnecting, useful for injecting net.Pipe in tests.
+func DialerOption(dialer func(ctx context.Context, network, addr string) (net.Conn, error)) ServerOption {
+	return func(o *options) {
+		o.dialer = dialer
+	}
+}
+
+// Dial connects to addr on network and returns a client connection which has
+// not started to serve requests yet.
+func Dial(ctx context.Context, network, addr string, opt ...ServerOption) (*ClientConn, error) {
+	opts := newClientOptions(opt)
+	c, err := dialConn(ctx, network, addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	cc := newClientConnWithOptions(netIdentifier.GetAndIncrement(), c, opts)
+	cc.network, cc.addr = network, addr
+	return cc, nil
+}
+
+// dialConn dials addr and performs TLS and custom handshakes on it.
+func dialConn(ctx context.Context, network, addr string, opts options) (net.Conn, error) {
+	if opts.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.dialTimeout)
+		defer cancel()
+	}
+
+	dial := opts.dialer
+	if dial == nil {
+		d := &net.Dialer{
+			LocalAddr: opts.localAddr,
+			KeepAlive: opts.keepAlive,
+		}
+		dial = d.DialContext
+	}
+	c, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.handshakeTimeout)
+		defer cancel()
+	}
+
+	if opts.tlsCfg != nil {
+		cfg := opts.tlsCfg
+		if cfg.ServerName == "" || opts.serverName != "" {
+			cfg = cfg.Clone()
+			cfg.ServerName = opts.serverName
+			if cfg.ServerName == "" {
+				if host, _, err := net.SplitHostPort(addr); err == nil {
+					cfg.ServerName = host
+				}
+			}
+		}
+		tc := tls.Client(c, cfg)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+
+	if opts.handshake != nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			c.SetDeadline(deadline)
+		}
+		err = opts.handshake(c)
+		c.SetDeadline(time.Time{})
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,142 @@
+package tao
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a server TLS config with a certificate for name, and a
+// client TLS config trusting it.
+func selfSigned(t *testing.T, name string) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool}
+	return server, client
+}
+
+func TestDial(t *testing.T) {
+	s, addr := startServer(t)
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	cc, err := Dial(context.Background(), "tcp", addr, DialTimeoutOption(time.Second), LocalAddrOption(local))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	cc.Start()
+
+	if ip := cc.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(local.IP) {
+		t.Fatalf("dialed from %v, want %v", ip, local.IP)
+	}
+	if got := cc.RemoteAddr().String(); got != addr {
+		t.Fatalf("dialed %s, want %s", got, addr)
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.conns.Size() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection dialed not accepted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	serverCfg, clientCfg := selfSigned(t, "tao.test")
+	_, addr := startServer(t, TLSCredsOption(serverCfg))
+
+	cc, err := Dial(context.Background(), "tcp", addr, TLSCredsOption(clientCfg), TLSServerNameOption("tao.test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	tc, ok := cc.session().rawConn.(*tls.Conn)
+	if !ok || !tc.ConnectionState().HandshakeComplete {
+		t.Fatal("TLS handshake not completed when dialed")
+	}
+
+	// certificate verified against the host part of address by default
+	if _, err = Dial(context.Background(), "tcp", addr, TLSCredsOption(clientCfg)); err == nil {
+		t.Fatal("dialed with certificate for another host")
+	}
+}
+
+func TestDialFailed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if _, err := Dial(context.Background(), "tcp", addr); err == nil {
+		t.Fatal("dialed to a closed port")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// dialer blocked until canceled
+	blocked := DialerOption(func(ctx context.Context, _, _ string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	start := time.Now()
+	_, err := Dial(context.Background(), "tcp", "tao.test:80", blocked, DialTimeoutOption(20*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dial timed out after %v", elapsed)
+	}
+
+	// peer accepting but never answering TLS handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	_, clientCfg := selfSigned(t, "tao.test")
+	_, err = Dial(context.Background(), "tcp", l.Addr().String(), TLSCredsOption(clientCfg), DialTimeoutOption(50*time.Millisecond))
+	if err == nil {
+		t.Fatal("dialed to peer never handshaking")
+	}
+}
@@ -8,16 +8,60 @@ Server represents a TCP server with various ServerOption supported.
 3. Provides callback on connected by OnConnectOption;
 4. Provides callback on meesage arrived by OnMessageOption;
 5. Provides callback on closed by OnCloseOption;
-6. Provides callback on error occurred by OnErrorOption;
+6. Provides callback on error occurred by OnErrorOption or OnConnErrorOption;
+7. Provides inbound rate limiting by ConnRateLimitOption, IPRateLimitOption and
+MessageRateLimitOption;
+8. Provides admission control by MaxConnsPerIPOption, MaxConnsPerCIDROption,
+AllowListOption, DenyListOption, AcceptRateOption and AdmitOption;
+9. Provides connection limits, queue sizes and worker numbers by ConfigOption,
+see ServerConfig;
+10. Provides PROXY protocol v1/v2 support behind load balancers by
+ProxyProtocolOption;
+11. Provides heart beats and idle connection eviction by HeartbeatOption;
+12. Provides deadlines by ReadTimeoutOption, WriteTimeoutOption and
+HandshakeTimeoutOption;
+13. Reports decode, encode, write, overflow, timeout errors and panics as
+ConnError to the callback set by OnConnErrorOption;
+14. Recovers from panics in handlers and timer callbacks, keeping workers
+alive, see PanicPolicyOption;
+15. Pauses reading from peer when handlers fall behind instead of dropping
+messages, counted by TotalSaturated;
+16. Scales worker go-routines between WorkersNum and MaxWorkers on queueing
+latency, keeping callbacks of each connection in order;
+17. Writes and handles messages by priority declared by PriorityOption or
+WriteWithPriority, with strict or weighted-fair SchedulingOption;
+18. Provides publish/subscribe on wildcard topics by Server.Subscribe and
+Server.Publish;
+19. Provides groups of connections with capacity, owner, membership events
+and timers by Server.NewGroup;
+20. Encodes broadcast messages once into shared buffers, pooled for codecs
+implementing AppendEncoder, see Server.BroadcastFunc;
+21. Multicasts messages to connections selected by attributes, using secondary
+indexes declared by Server.IndexAttribute, see Server.Multicast;
+22. Registers typed handlers by Handle on a Router, unmarshaling messages by
+their own Unmarshal methods, see RouterOption;
+23. Sends ErrorMessage back to peer when a handler registered by RegisterFunc
+or Handle returns an error, which is returned as a typed error by
+ClientConn.Call waiting for Correlated responses;
+24. Negotiates protocol version at connection start by ProtocolVersionOption,
+decoding frames of older peers by VersionOption with upconverters;
 
 ServerConn represents a connection on the server side.
 
-ClientConn represents a connection connect to other servers. You can make it
-reconnectable by passing ReconnectOption when creating.
+ClientConn represents a connection connect to other servers, created by Dial or
+NewClientConn on a connection dialed by yourself. You can make it
+reconnectable by passing ReconnectOption when creating, it then redials with
+exponential backoff set by ReconnectBackoffOption in the background whenever
+the connection is lost, and reports its state to the callback set by
+OnReconnectOption. Calling Close stops reconnecting.
+
+ClientPool holds connections to a set of servers and balances messages among
+them by RoundRobin, LeastPending or ConsistentHash.
 
 AtomicInt64, AtomicInt32 and AtomicBoolean are providing concurrent-safe atomic
-types in a Java-like style while ConnMap is a go-routine safe map for connection
-management.
+types in a Java-like style, ConcurrentMap is a generic go-routine safe map, and
+ConnMap built on it is the map for connection management, iterated by Range or
+Snapshot without blocking connections from being accepted or closed.
 
 Every handler function is defined as func(context.Context, WriteCloser). Usually
 a meesage and a net ID are shifted within the Context, developers can retrieve
@@ -52,7 +96,8 @@ codec:
 
 TimingWheel is a safe timer for running timed callbacks on connection.
 
-WorkerPool is a go-routine pool for running message handlers, you can fetch one
-by calling func WorkerPoolInstance() *WorkerPool.
+WorkerPool is a go-routine pool for running message handlers, each server owns
+one sized by ServerConfig.WorkersNum, and a global one can be fetched by calling
+func WorkerPoolInstance() *WorkerPool.
 */
 package tao
@@ -26,8 +26,8 @@ func main() {
 		return true
 	})
 
-	onError := tao.OnErrorOption(func(c tao.WriteCloser) {
-		seelog.Infof("on error")
+	onError := tao.OnConnErrorOption(func(c tao.WriteCloser, err *tao.ConnError) {
+		seelog.Infof("on error %v", err)
 	})
 
 	onClose := tao.OnCloseOption(func(c tao.WriteCloser) {
@@ -21,8 +21,8 @@ func NewChatServer() *ChatServer {
 		seelog.Infof("on connect")
 		return true
 	})
-	onErrorOption := tao.OnErrorOption(func(conn tao.WriteCloser) {
-		seelog.Infof("on error")
+	onErrorOption := tao.OnConnErrorOption(func(conn tao.WriteCloser, err *tao.ConnError) {
+		seelog.Infof("on error %v", err)
 	})
 	onCloseOption := tao.OnCloseOption(func(conn tao.WriteCloser) {
 		seelog.Infof("close chat client")
@@ -24,8 +24,8 @@ func main() {
 		return true
 	})
 
-	onError := tao.OnErrorOption(func(conn tao.WriteCloser) {
-		seelog.Infof("on error")
+	onError := tao.OnConnErrorOption(func(conn tao.WriteCloser, err *tao.ConnError) {
+		seelog.Infof("on error %v", err)
 	})
 
 	onClose := tao.OnCloseOption(func(conn tao.WriteCloser) {
@@ -27,8 +27,8 @@ func NewEchoServer() *EchoServer {
 		seelog.Infof("closing client")
 	})
 
-	onError := tao.OnErrorOption(func(conn tao.WriteCloser) {
-		seelog.Infof("on error")
+	onError := tao.OnConnErrorOption(func(conn tao.WriteCloser, err *tao.ConnError) {
+		seelog.Infof("on error %v", err)
 	})
 
 	onMessage := tao.OnMessageOption(func(msg tao.Message, conn tao.WriteCloser) {
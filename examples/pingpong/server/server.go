@@ -23,8 +23,8 @@ func NewPingPongServer() *PingPongServer {
 		return true
 	})
 
-	onError := tao.OnErrorOption(func(conn tao.WriteCloser) {
-		seelog.Infof("on error")
+	onError := tao.OnConnErrorOption(func(conn tao.WriteCloser, err *tao.ConnError) {
+		seelog.Infof("on error %v", err)
 	})
 
 	onClose := tao.OnCloseOption(func(conn tao.WriteCloser) {
@@ -16,7 +16,7 @@ import (
 
 func main() {
 	p := msg.PlayCardRsp{}
-	tao.Register(p.MessageNumber(), msg.DeserializePlayCardRspMessage, ProcessMessage)
+	tao.Handle(tao.DefaultRouter, p.MessageNumber(), ProcessMessage)
 	p2 := msg.PlayCardReq{}
 	tao.Register(p2.MessageNumber(), msg.DeserializePlayCardReqMessage, nil)
 
@@ -30,8 +30,8 @@ func main() {
 		return true
 	})
 
-	onError := tao.OnErrorOption(func(conn tao.WriteCloser) {
-		seelog.Infof("on error")
+	onError := tao.OnConnErrorOption(func(conn tao.WriteCloser, err *tao.ConnError) {
+		seelog.Infof("on error %v", err)
 	})
 
 	onClose := tao.OnCloseOption(func(conn tao.WriteCloser) {
@@ -68,7 +68,7 @@ func main() {
 }
 
 // ProcessPingPongMessage handles business logic.
-func ProcessMessage(ctx context.Context, conn tao.WriteCloser) {
-	re := tao.MessageFromContext(ctx).(*msg.PlayCardRsp)
+func ProcessMessage(ctx context.Context, re *msg.PlayCardRsp, conn tao.WriteCloser) error {
 	seelog.Infof("resp %d",re.Data.GetCode())
+	return nil
 }
@@ -23,6 +23,11 @@ func (em *PlayCardReq) MessageNumber() int32 {
 	return 1
 }
 
+// Unmarshal unmarshals bytes into Message.
+func (em *PlayCardReq) Unmarshal(data []byte) error {
+	return proto.Unmarshal(data, &em.Data)
+}
+
 // DeserializeMessage deserializes bytes into Message.
 func DeserializePlayCardReqMessage(data []byte) (message tao.Message, err error) {
 	if data == nil {
@@ -34,15 +39,14 @@ func DeserializePlayCardReqMessage(data []byte) (message tao.Message, err error)
 }
 
 // ProcessMessage process the logic of echo message.
-func ProcessPlayCardReqMessage(ctx context.Context, conn tao.WriteCloser) {
-	rep := tao.MessageFromContext(ctx).(*PlayCardReq)
+func ProcessPlayCardReqMessage(ctx context.Context, rep *PlayCardReq, conn tao.WriteCloser) error {
 	seelog.Infof("receving message %v\n", rep.Data)
 	seelog.Infof("receving message %v\n", rep.Data.GetCard())
 	seelog.Infof("receving message %v\n", rep.Data.GetCard().Card)
 
 	rsp := new(PlayCardRsp)
 	rsp.Data.Code = proto.Int32(3)
-	conn.Write(rsp)
+	return conn.Write(rsp)
 }
 
 // Message defines the echo message.
@@ -60,6 +64,11 @@ func (em *PlayCardRsp) MessageNumber() int32 {
 	return 2
 }
 
+// Unmarshal unmarshals bytes into Message.
+func (em *PlayCardRsp) Unmarshal(data []byte) error {
+	return proto.Unmarshal(data, &em.Data)
+}
+
 // DeserializeMessage deserializes bytes into Message.
 func DeserializePlayCardRspMessage(data []byte) (message tao.Message, err error) {
 	if data == nil {
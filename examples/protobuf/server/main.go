@@ -26,8 +26,8 @@ func NewEchoServer() *EchoServer {
 		seelog.Infof("closing client")
 	})
 
-	onError := tao.OnErrorOption(func(conn tao.WriteCloser) {
-		seelog.Infof("on error")
+	onError := tao.OnConnErrorOption(func(conn tao.WriteCloser, err *tao.ConnError) {
+		seelog.Infof("on error %v", err)
 	})
 
 	onMessage := tao.OnMessageOption(func(msg tao.Message, conn tao.WriteCloser) {
@@ -46,9 +46,7 @@ func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	n := msg.PlayCardReq{}
-	tao.Register(n.MessageNumber(),
-		msg.DeserializePlayCardReqMessage,
-		msg.ProcessPlayCardReqMessage)
+	tao.Handle(tao.DefaultRouter, n.MessageNumber(), msg.ProcessPlayCardReqMessage)
 
 	l, err := net.Listen("tcp", ":12345")
 	if err != nil {
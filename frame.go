@@ -0,0 +1,139 @@
+package tao
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// AppendEncoder is implemented by codecs able to encode message by appending
+// to a buffer, which lets broadcasts reuse pooled buffers.
+type AppendEncoder interface {
+	AppendEncode(dst []byte, msg Message) ([]byte, error)
+}
+
+// AppendEncode appends the TLV frame of msg to dst.
+func (codec TypeLengthValueCodec) AppendEncode(dst []byte, msg Message) ([]byte, error) {
+	data, err := msg.Serialize()
+	if err != nil {
+		return dst, err
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(msg.MessageNumber()))
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(data)))
+	return append(dst, data...), nil
+}
+
+// maxPooledFrame is the largest buffer kept in framePool.
+const maxPooledFrame = 64 * 1024
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+// frame is an encoded message shared by connections, the buffer goes back to
+// pool when the last reference is released.
+type frame struct {
+	data   []byte
+	refs   int32
+	pooled *[]byte
+}
+
+// encodeFrame encodes msg once, the frame returned holds one reference for the
+// caller.
+func encodeFrame(codec Codec, msg Message) (*frame, error) {
+	if ae, ok := codec.(AppendEncoder); ok {
+		buf := framePool.Get().(*[]byte)
+		data, err := ae.AppendEncode((*buf)[:0], msg)
+		if err != nil {
+			framePool.Put(buf)
+			return nil, err
+		}
+		*buf = data
+		return &frame{data: data, refs: 1, pooled: buf}, nil
+	}
+
+	data, err := codec.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &frame{data: data, refs: 1}, nil
+}
+
+func (f *frame) retain() {
+	atomic.AddInt32(&f.refs, 1)
+}
+
+func (f *frame) release() {
+	if f == nil {
+		return
+	}
+	if atomic.AddInt32(&f.refs, -1) == 0 && f.pooled != nil {
+		if cap(*f.pooled) <= maxPooledFrame {
+			framePool.Put(f.pooled)
+		}
+		f.data, f.pooled = nil, nil
+	}
+}
+
+// ErrBroadcast is returned by broadcasts when msg could not be queued to some of
+// the connections, such as those saturated. Err is the last error, errors.Is
+// tells ErrWouldBlock from it.
+type ErrBroadcast struct {
+	Failed int
+	Total  int
+	Err    error
+}
+
+func (e ErrBroadcast) Error() string {
+	return fmt.Sprintf("broadcast failed on %d of %d connections: %v", e.Failed, e.Total, e.Err)
+}
+
+// Unwrap returns the last error.
+func (e ErrBroadcast) Unwrap() error {
+	return e.Err
+}
+
+// BroadcastFunc sends msg to all server connections for which filter returns
+// true, or all of them if filter is nil. The message is encoded once and the
+// bytes are shared by all the connections. ErrBroadcast is returned if it could
+// not be queued to some of them.
+func (s *Server) BroadcastFunc(msg Message, filter func(*ServerConn) bool) error {
+	return s.fanout(msg, s.conns.Snapshot(), filter)
+}
+
+// fanout encodes msg once and queues it to conns passing filter, returning
+// ErrBroadcast if failed on any of them.
+func (s *Server) fanout(msg Message, conns []*ServerConn, filter func(*ServerConn) bool) error {
+	if len(conns) == 0 {
+		return nil
+	}
+	f, err := encodeFrame(s.opts.codec, msg)
+	if err != nil {
+		return err
+	}
+	defer f.release()
+
+	p := priorityOf(s.opts.router, msg)
+	var be ErrBroadcast
+	for _, sc := range conns {
+		if filter != nil && !filter(sc) {
+			continue
+		}
+		be.Total++
+		if err := sc.writeFrame(f, msg, p); err != nil {
+			if s.logger != nil {
+				s.logger.Errorf("broadcast to %d error %v\n", sc.GetNetID(), err)
+			}
+			be.Failed++
+			be.Err = err
+		}
+	}
+	if be.Failed > 0 {
+		return be
+	}
+	return nil
+}
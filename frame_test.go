@@ -0,0 +1,54 @@
+package tao
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/fanyang1988/tao/logger"
+)
+
+// pipeServerConns returns n server connections not started on pipes.
+func pipeServerConns(t *testing.T, s *Server, n int) []*ServerConn {
+	t.Helper()
+	conns := make([]*ServerConn, n)
+	for i := range conns {
+		client, server := net.Pipe()
+		t.Cleanup(func() {
+			client.Close()
+			server.Close()
+		})
+		conns[i] = NewServerConn(int64(i), s, server)
+	}
+	return conns
+}
+
+func TestFanoutSaturated(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.SendQueueSize = 2
+	s := NewServer(logger.NewNullLogger(), ConfigOption(cfg))
+	defer s.Stop()
+	conns := pipeServerConns(t, s, 3)
+	msg := outboxMessage(0)
+
+	// the last connection is filtered out
+	filter := func(sc *ServerConn) bool { return sc.GetNetID() < 2 }
+	for i := 0; i < 2; i++ {
+		if err := s.fanout(msg, conns, filter); err != nil {
+			t.Fatalf("fanout %d: %v", i, err)
+		}
+	}
+	conns[1].sendQ.tryPop()
+
+	err := s.fanout(msg, conns, filter)
+	var be ErrBroadcast
+	if !errors.As(err, &be) {
+		t.Fatalf("fanout to saturated got %v, want ErrBroadcast", err)
+	}
+	if be.Failed != 1 || be.Total != 2 {
+		t.Fatalf("failed on %d of %d connections, want 1 of 2", be.Failed, be.Total)
+	}
+	if !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("got %v, want ErrWouldBlock wrapped", err)
+	}
+}
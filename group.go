@@ -0,0 +1,384 @@
+package tao
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type groupOptions struct {
+	capacity int
+	owner    int64
+	hasOwner bool
+	onJoin   func(*Group, *ServerConn)
+	onLeave  func(*Group, *ServerConn)
+}
+
+// GroupOption sets options of Group.
+type GroupOption func(*groupOptions)
+
+// GroupCapacityOption returns a GroupOption that limits the number of members,
+// 0 means unlimited.
+func GroupCapacityOption(capacity int) GroupOption {
+	return func(o *groupOptions) {
+		o.capacity = capacity
+	}
+}
+
+// GroupOwnerOption returns a GroupOption that sets the owner of group, it does
+// not join the group by itself.
+func GroupOwnerOption(netID int64) GroupOption {
+	return func(o *groupOptions) {
+		o.owner = netID
+		o.hasOwner = true
+	}
+}
+
+// OnGroupJoinOption returns a GroupOption that will set callback to call after
+// a connection joined the group. Callbacks of joining and leaving run on the
+// worker of group, in the order of membership changes.
+func OnGroupJoinOption(cb func(*Group, *ServerConn)) GroupOption {
+	return func(o *groupOptions) {
+		o.onJoin = cb
+	}
+}
+
+// OnGroupLeaveOption returns a GroupOption that will set callback to call after
+// a connection left the group, including when it closed or the group removed.
+// It is never called before the callback of joining of the same connection.
+func OnGroupLeaveOption(cb func(*Group, *ServerConn)) GroupOption {
+	return func(o *groupOptions) {
+		o.onLeave = cb
+	}
+}
+
+// Group is a set of server connections, such as a game room, managed by Server.
+type Group struct {
+	name     string
+	belong   *Server
+	opts     groupOptions
+	members  *ConnMap
+	mu       sync.Mutex // guards following
+	owner    int64
+	hasOwner bool
+	pending  []int64
+	closed   bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// groupRegistry holds groups of server and the groups each connection is in.
+type groupRegistry struct {
+	mu     sync.Mutex // guards following
+	byName map[string]*Group
+	byConn map[int64]map[*Group]struct{}
+}
+
+func newGroupRegistry() *groupRegistry {
+	return &groupRegistry{
+		byName: make(map[string]*Group),
+		byConn: make(map[int64]map[*Group]struct{}),
+	}
+}
+
+func (r *groupRegistry) link(netID int64, g *Group) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	groups, ok := r.byConn[netID]
+	if !ok {
+		groups = make(map[*Group]struct{})
+		r.byConn[netID] = groups
+	}
+	groups[g] = struct{}{}
+}
+
+func (r *groupRegistry) unlink(netID int64, g *Group) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if groups, ok := r.byConn[netID]; ok {
+		delete(groups, g)
+		if len(groups) == 0 {
+			delete(r.byConn, netID)
+		}
+	}
+}
+
+// removeConn makes netID leave all the groups it is in.
+func (r *groupRegistry) removeConn(netID int64) {
+	r.mu.Lock()
+	groups := r.byConn[netID]
+	delete(r.byConn, netID)
+	r.mu.Unlock()
+
+	for g := range groups {
+		g.Leave(netID)
+	}
+}
+
+// NewGroup creates a group of name, an error is returned if it exists.
+func (s *Server) NewGroup(name string, opt ...GroupOption) (*Group, error) {
+	var opts groupOptions
+	for _, o := range opt {
+		o(&opts)
+	}
+	g := &Group{
+		name:     name,
+		belong:   s,
+		opts:     opts,
+		members:  NewConnMap(),
+		owner:    opts.owner,
+		hasOwner: opts.hasOwner,
+		pending:  []int64{},
+	}
+	g.ctx, g.cancel = context.WithCancel(context.WithValue(s.ctx, groupCtx, g))
+
+	s.groups.mu.Lock()
+	defer s.groups.mu.Unlock()
+	if _, ok := s.groups.byName[name]; ok {
+		g.cancel()
+		return nil, ErrGroupExists
+	}
+	s.groups.byName[name] = g
+	return g, nil
+}
+
+// GetGroup returns the group of name.
+func (s *Server) GetGroup(name string) (*Group, bool) {
+	s.groups.mu.Lock()
+	defer s.groups.mu.Unlock()
+	g, ok := s.groups.byName[name]
+	return g, ok
+}
+
+// RemoveGroup removes the group of name, all members leave it and its timers
+// are cancelled.
+func (s *Server) RemoveGroup(name string) {
+	s.groups.mu.Lock()
+	g, ok := s.groups.byName[name]
+	delete(s.groups.byName, name)
+	s.groups.mu.Unlock()
+	if ok {
+		g.close()
+	}
+}
+
+// Name returns the name of group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Owner returns the net ID of owner, false if the group has no owner.
+func (g *Group) Owner() (int64, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.owner, g.hasOwner
+}
+
+// SetOwner sets the owner of group.
+func (g *Group) SetOwner(netID int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.owner, g.hasOwner = netID, true
+}
+
+// Capacity returns the maximum number of members, 0 means unlimited.
+func (g *Group) Capacity() int {
+	return g.opts.capacity
+}
+
+// Size returns the number of members.
+func (g *Group) Size() int {
+	return g.members.Size()
+}
+
+// Contains tells whether netID is a member.
+func (g *Group) Contains(netID int64) bool {
+	_, ok := g.members.Get(netID)
+	return ok
+}
+
+// Join adds connection netID to the group, it is a no-op if already joined.
+// ErrGroupFull is returned if the group reaches its capacity.
+func (g *Group) Join(netID int64) error {
+	sc, ok := g.belong.conns.Get(netID)
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrConnNotFound, netID)
+	}
+
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return ErrGroupClosed
+	}
+	if _, ok := g.members.Get(netID); ok {
+		g.mu.Unlock()
+		return nil
+	}
+	if g.opts.capacity > 0 && g.members.Size() >= g.opts.capacity {
+		g.mu.Unlock()
+		return ErrGroupFull
+	}
+	g.members.Put(netID, sc)
+	g.belong.groups.link(netID, g)
+	g.notify(g.opts.onJoin, sc)
+	g.mu.Unlock()
+
+	// the connection may have closed and cleaned up in between
+	if _, ok := g.belong.conns.Get(netID); !ok {
+		g.Leave(netID)
+		return fmt.Errorf("%w: %d", ErrConnNotFound, netID)
+	}
+	return nil
+}
+
+// Leave removes connection netID from the group, the owner is cleared if it is
+// the one leaving.
+func (g *Group) Leave(netID int64) {
+	g.mu.Lock()
+	sc, ok := g.members.Get(netID)
+	if !ok {
+		g.mu.Unlock()
+		return
+	}
+	g.members.Remove(netID)
+	g.belong.groups.unlink(netID, g)
+	if g.hasOwner && g.owner == netID {
+		g.hasOwner = false
+	}
+	g.notify(g.opts.onLeave, sc)
+	g.mu.Unlock()
+}
+
+// Members returns the net IDs of members.
+func (g *Group) Members() []int64 {
+	conns := g.members.Snapshot()
+	ids := make([]int64, len(conns))
+	for i, sc := range conns {
+		ids[i] = sc.netid
+	}
+	return ids
+}
+
+// Broadcast sends msg to all members, the message is encoded once and the
+// bytes are shared by all of them. ErrBroadcast is returned if it could not be
+// queued to some of them.
+func (g *Group) Broadcast(msg Message) error {
+	return g.belong.fanout(msg, g.members.Snapshot(), nil)
+}
+
+// RunAt runs a callback of group at the specified timestamp.
+func (g *Group) RunAt(timestamp time.Time, callback func(time.Time, *Group)) int64 {
+	return g.addTimer(timestamp, 0, callback)
+}
+
+// RunAfter runs a callback of group right after the specified duration ellapsed.
+func (g *Group) RunAfter(duration time.Duration, callback func(time.Time, *Group)) int64 {
+	return g.addTimer(time.Now().Add(duration), 0, callback)
+}
+
+// RunEvery runs a callback of group on every interval time, such as the tick
+// of a game room. Callbacks of one group are run in order on worker pool.
+func (g *Group) RunEvery(interval time.Duration, callback func(time.Time, *Group)) int64 {
+	return g.addTimer(time.Now().Add(interval), interval, callback)
+}
+
+// CancelTimer cancels a timer of group with the specified ID.
+func (g *Group) CancelTimer(timerID int64) {
+	cancelTimer(g.belong.timing, timerID)
+}
+
+func (g *Group) addTimer(when time.Time, interv time.Duration, callback func(time.Time, *Group)) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return -1
+	}
+	timeout := NewOnTimeOut(g.ctx, func(t time.Time, _ WriteCloser) {
+		callback(t, g)
+	})
+	id := g.belong.timing.AddTimer(when, interv, timeout)
+	if id >= 0 {
+		g.pending = append(g.pending, id)
+	}
+	return id
+}
+
+// dispatch runs a timeout callback of group on worker pool.
+func (g *Group) dispatch(timeout *OnTimeOut) {
+	logger := g.belong.logger
+	err := g.belong.workers.Put(g, func() {
+		defer func() {
+			if p := recover(); p != nil {
+				if logger != nil {
+					logger.Errorf("panics in group %s timer: %v\n%s", g.name, p, stackTrace())
+				}
+			}
+		}()
+		timeout.Callback(time.Now(), nil)
+	})
+	if err != nil && logger != nil {
+		logger.Errorf("group %s timer dropped %v\n", g.name, err)
+	}
+}
+
+// notify runs callback of membership change on the worker of group, the same
+// one running its timers, so that callbacks are called in the order of changes.
+// It must be called with g.mu held.
+func (g *Group) notify(cb func(*Group, *ServerConn), sc *ServerConn) {
+	if cb == nil {
+		return
+	}
+	logger := g.belong.logger
+	run := func() {
+		defer func() {
+			if p := recover(); p != nil {
+				if logger != nil {
+					logger.Errorf("panics in group %s callback: %v\n%s", g.name, p, stackTrace())
+				}
+			}
+		}()
+		cb(g, sc)
+	}
+	if err := g.belong.workers.Put(g, run); err != nil {
+		if logger != nil {
+			logger.Warnf("group %s callback out of order %v\n", g.name, err)
+		}
+		go run()
+	}
+}
+
+// SetContextValue sets extra data to group.
+func (g *Group) SetContextValue(k, v interface{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ctx = context.WithValue(g.ctx, k, v)
+}
+
+// GetContextValue gets extra data from group.
+func (g *Group) GetContextValue(k interface{}) interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.ctx.Value(k)
+}
+
+// close cancels timers and makes all members leave.
+func (g *Group) close() {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return
+	}
+	g.closed = true
+	pending := g.pending
+	g.pending = nil
+	g.cancel()
+	g.mu.Unlock()
+
+	for _, id := range pending {
+		g.CancelTimer(id)
+	}
+	for _, id := range g.Members() {
+		g.Leave(id)
+	}
+}
@@ -0,0 +1,130 @@
+package tao
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// connectClients dials n clients to the server at addr, returning the net IDs
+// of server connections.
+func connectClients(t *testing.T, s *Server, addr string, n int) []int64 {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		cc, err := Dial(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc.Start()
+		t.Cleanup(cc.Close)
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.conns.Size() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d connections accepted", s.conns.Size(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var ids []int64
+	for _, sc := range s.conns.Snapshot() {
+		ids = append(ids, sc.GetNetID())
+	}
+	return ids
+}
+
+func TestGroupMembership(t *testing.T) {
+	s, addr := startServer(t)
+	ids := connectClients(t, s, addr, 3)
+
+	g, err := s.NewGroup("room", GroupCapacityOption(2), GroupOwnerOption(ids[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.NewGroup("room"); err != ErrGroupExists {
+		t.Fatalf("duplicate group got %v, want ErrGroupExists", err)
+	}
+	if err := g.Join(-1); !errors.Is(err, ErrConnNotFound) {
+		t.Fatalf("join unknown connection got %v, want ErrConnNotFound", err)
+	}
+	for _, id := range ids[:2] {
+		if err := g.Join(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Join(ids[0]); err != nil {
+		t.Fatalf("join again got %v, want nil", err)
+	}
+	if err := g.Join(ids[2]); err != ErrGroupFull {
+		t.Fatalf("join full group got %v, want ErrGroupFull", err)
+	}
+
+	g.Leave(ids[0])
+	if g.Contains(ids[0]) || g.Size() != 1 {
+		t.Fatalf("members %v after left", g.Members())
+	}
+	if _, ok := g.Owner(); ok {
+		t.Fatal("owner kept after left")
+	}
+
+	s.RemoveGroup("room")
+	if g.Size() != 0 {
+		t.Fatalf("members %v after group removed", g.Members())
+	}
+	if err := g.Join(ids[2]); err != ErrGroupClosed {
+		t.Fatalf("join removed group got %v, want ErrGroupClosed", err)
+	}
+}
+
+func TestGroupLeaveOnClose(t *testing.T) {
+	s, addr := startServer(t)
+	ids := connectClients(t, s, addr, 1)
+	left := make(chan int64, 1)
+	g, _ := s.NewGroup("room", OnGroupLeaveOption(func(_ *Group, sc *ServerConn) {
+		left <- sc.GetNetID()
+	}))
+	g.Join(ids[0])
+
+	sc, _ := s.GetConn(ids[0])
+	sc.Close()
+	select {
+	case id := <-left:
+		if id != ids[0] {
+			t.Fatalf("connection %d left, want %d", id, ids[0])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("closed connection not left")
+	}
+	if g.Size() != 0 {
+		t.Fatal("closed connection still a member")
+	}
+}
+
+func TestGroupCallbacksInOrder(t *testing.T) {
+	s, addr := startServer(t)
+	ids := connectClients(t, s, addr, 1)
+	const rounds = 100
+	events := make(chan string, 2*rounds)
+	g, _ := s.NewGroup("room",
+		OnGroupJoinOption(func(*Group, *ServerConn) { events <- "join" }),
+		OnGroupLeaveOption(func(*Group, *ServerConn) { events <- "leave" }),
+	)
+	for i := 0; i < rounds; i++ {
+		g.Join(ids[0])
+		g.Leave(ids[0])
+	}
+	for i := 0; i < 2*rounds; i++ {
+		want := "join"
+		if i%2 == 1 {
+			want = "leave"
+		}
+		select {
+		case ev := <-events:
+			if ev != want {
+				t.Fatalf("event %d is %s, want %s", i, ev, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not called", i)
+		}
+	}
+}
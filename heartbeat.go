@@ -0,0 +1,84 @@
+package tao
+
+import (
+	"time"
+)
+
+// HeartbeatOption returns a ServerOption that keeps connections alive. ClientConn
+// sends a HeartBeatMessage every interval and ServerConn with this option
+// echoes it back, so the round-trip time is measured on client, see
+// ClientConn.RTT. Servers only answer heart beats, so ServerConn has no RTT.
+// Both sides close the connection if nothing has been heard from peer for
+// longer than timeout, 0 means never. Without this option heart beats go to
+// the handler registered for HeartBeat, if any.
+func HeartbeatOption(interval, timeout time.Duration) ServerOption {
+	return func(o *options) {
+		o.heartInterval = interval
+		o.heartTimeout = timeout
+	}
+}
+
+// heartbeatEnabled tells whether built-in heart beats handling is on.
+func (o options) heartbeatEnabled() bool {
+	return o.heartInterval > 0 || o.heartTimeout > 0
+}
+
+// checkInterval returns how often to look for idle peer.
+func (o options) checkInterval() time.Duration {
+	if o.heartInterval > 0 && o.heartInterval < o.heartTimeout {
+		return o.heartInterval
+	}
+	return o.heartTimeout / 2
+}
+
+// startHeartBeat schedules heart beats of server connection.
+func (sc *ServerConn) startHeartBeat() {
+	opts := sc.belong.opts
+	if opts.heartTimeout <= 0 {
+		return
+	}
+	sc.RunEvery(opts.checkInterval(), func(now time.Time, c WriteCloser) {
+		checkIdle(now, sc.GetHeartBeat(), opts.heartTimeout, sc.Close)
+	})
+}
+
+// startHeartBeat schedules heart beats of session s of client connection.
+func (cc *ClientConn) startHeartBeat(s *clientSession) {
+	opts := cc.opts
+	if opts.heartInterval > 0 {
+		cc.runEvery(s, opts.heartInterval, func(now time.Time, c WriteCloser) {
+			if err := c.Write(HeartBeatMessage{Timestamp: now.UnixNano()}); err != nil {
+				if cc.logger != nil {
+					cc.logger.Warnf("error sending heart beat %v\n", err)
+				}
+			}
+		})
+	}
+	if opts.heartTimeout > 0 {
+		cc.runEvery(s, opts.checkInterval(), func(now time.Time, c WriteCloser) {
+			checkIdle(now, cc.GetHeartBeat(), opts.heartTimeout, func() { cc.drop(s) })
+		})
+	}
+}
+
+// checkIdle calls drop if the last heart beat is older than timeout.
+func checkIdle(now time.Time, heart int64, timeout time.Duration, drop func()) {
+	if now.Sub(time.Unix(0, heart)) > timeout {
+		// drop waits for handleLoop which is running this callback.
+		go drop()
+	}
+}
+
+// RTT returns the round-trip time measured by the latest heart beat, 0 if not
+// measured yet.
+func (cc *ClientConn) RTT() time.Duration {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.sess.rtt
+}
+
+func (cc *ClientConn) setRTT(rtt time.Duration) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.sess.rtt = rtt
+}
@@ -0,0 +1,85 @@
+package tao
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fanyang1988/tao/logger"
+)
+
+// startServer starts a server listening on a random local port.
+func startServer(t *testing.T, opt ...ServerOption) (*Server, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(logger.NewNullLogger(), opt...)
+	go s.Start(l)
+	t.Cleanup(s.Stop)
+	return s, l.Addr().String()
+}
+
+func TestHandleHeartBeat(t *testing.T) {
+	cc := pipeClient(t)
+	ctx := NewContextWithMessage(context.Background(), HeartBeatMessage{Timestamp: 42})
+	HandleHeartBeat(ctx, cc)
+	if heart := cc.GetHeartBeat(); heart != 42 {
+		t.Fatalf("heart beat %d, want the timestamp carried 42", heart)
+	}
+}
+
+func TestServerEchoesHeartBeat(t *testing.T) {
+	_, addr := startServer(t, HeartbeatOption(0, time.Minute))
+	cc, err := Dial(context.Background(), "tcp", addr, HeartbeatOption(10*time.Millisecond, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	cc.Start()
+
+	deadline := time.Now().Add(time.Second)
+	for cc.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("heart beats not echoed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerNotEchoHeartBeat(t *testing.T) {
+	// no HeartbeatOption on server
+	_, addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	writeFrame(t, conn, HeartBeatMessage{Timestamp: 1})
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if msg, err := (TypeLengthValueCodec{}).Decode(conn); err == nil {
+		t.Fatalf("answered %#v without HeartbeatOption", msg)
+	}
+}
+
+func TestCheckIdle(t *testing.T) {
+	now := time.Now()
+	closed := make(chan struct{}, 1)
+	drop := func() { closed <- struct{}{} }
+
+	checkIdle(now, now.Add(-time.Millisecond).UnixNano(), time.Second, drop)
+	checkIdle(now, now.Add(-2*time.Second).UnixNano(), time.Second, drop)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("idle connection not closed")
+	}
+	select {
+	case <-closed:
+		t.Fatal("active connection closed")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
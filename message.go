@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
-	"fmt"
 	"github.com/cihub/seelog"
 	"io"
 	"net"
@@ -13,6 +12,10 @@ import (
 const (
 	// HeartBeat is the default heart beat message number.
 	HeartBeat = 0
+	// ErrorMessageNumber is the message number of ErrorMessage.
+	ErrorMessageNumber = -2
+	// VersionMessageNumber is the message number of VersionMessage.
+	VersionMessageNumber = -3
 )
 
 // Handler takes the responsibility to handle incoming messages.
@@ -28,59 +31,62 @@ func (f HandlerFunc) Handle(ctx context.Context, c WriteCloser) {
 	f(ctx, c)
 }
 
+// handleFunc is a handler function returning error, which is reported to
+// OnConnErrorOption and sent back to peer as ErrorMessage, see replyError.
+type handleFunc func(context.Context, WriteCloser) error
+
 // UnmarshalFunc unmarshals bytes into Message.
 type UnmarshalFunc func([]byte) (Message, error)
 
 // handlerUnmarshaler is a combination of unmarshal and handle functions for message.
 type handlerUnmarshaler struct {
-	handler     HandlerFunc
+	handler     handleFunc
 	unmarshaler UnmarshalFunc
+	acl         *ACL
+	priority    Priority
+	versions    []versionedUnmarshaler // sorted by version
 }
 
-var (
-	buf *bytes.Buffer
-	// messageRegistry is the registry of all
-	// message-related unmarshal and handle functions.
-	messageRegistry map[int32]handlerUnmarshaler
-)
-
-func init() {
-	messageRegistry = map[int32]handlerUnmarshaler{}
-	buf = new(bytes.Buffer)
-}
-
-// Register registers the unmarshal and handle functions for msgType.
+// Register registers the unmarshal and handle functions for msgType on
+// DefaultRouter.
 // If no unmarshal function provided, the message will not be parsed.
 // If no handler function provided, the message will not be handled unless you
 // set a default one by calling SetOnMessageCallback.
 // If Register being called twice on one msgType, it will panics.
-func Register(msgType int32, unmarshaler func([]byte) (Message, error), handler func(context.Context, WriteCloser)) {
-	if _, ok := messageRegistry[msgType]; ok {
-		panic(fmt.Sprintf("trying to register message %d twice", msgType))
-	}
+// Access to the handler can be restricted by passing RolesOption or ScopesOption,
+// and its priority declared by PriorityOption.
+func Register(msgType int32, unmarshaler func([]byte) (Message, error), handler func(context.Context, WriteCloser), opts ...RegisterOption) {
+	DefaultRouter.Register(msgType, unmarshaler, handler, opts...)
+}
 
-	messageRegistry[msgType] = handlerUnmarshaler{
-		unmarshaler: unmarshaler,
-		handler:     HandlerFunc(handler),
-	}
+// RegisterFunc is like Register but handler returns an error, which is
+// reported to OnConnErrorOption and sent back to peer as ErrorMessage.
+func RegisterFunc(msgType int32, unmarshaler func([]byte) (Message, error), handler func(context.Context, WriteCloser) error, opts ...RegisterOption) {
+	DefaultRouter.RegisterFunc(msgType, unmarshaler, handler, opts...)
 }
 
-// GetUnmarshalFunc returns the corresponding unmarshal function for msgType.
+// GetUnmarshalFunc returns the corresponding unmarshal function for msgType
+// on DefaultRouter.
 func GetUnmarshalFunc(msgType int32) UnmarshalFunc {
-	entry, ok := messageRegistry[msgType]
-	if !ok {
-		return nil
-	}
-	return entry.unmarshaler
+	return DefaultRouter.UnmarshalFunc(msgType)
 }
 
-// GetHandlerFunc returns the corresponding handler function for msgType.
+// GetHandlerFunc returns the corresponding handler function for msgType on
+// DefaultRouter.
 func GetHandlerFunc(msgType int32) HandlerFunc {
-	entry, ok := messageRegistry[msgType]
-	if !ok {
-		return nil
-	}
-	return entry.handler
+	return DefaultRouter.HandlerFunc(msgType)
+}
+
+// GetACL returns the access control list declared for msgType on
+// DefaultRouter, nil if any principal is allowed.
+func GetACL(msgType int32) *ACL {
+	return DefaultRouter.ACL(msgType)
+}
+
+// GetPriority returns the priority declared for msgType on DefaultRouter,
+// heart beats are of PriorityHigh unless declared otherwise.
+func GetPriority(msgType int32) Priority {
+	return DefaultRouter.Priority(msgType)
 }
 
 // Message represents the structured data that can be handled.
@@ -96,7 +102,7 @@ type HeartBeatMessage struct {
 
 // Serialize serializes HeartBeatMessage into bytes.
 func (hbm HeartBeatMessage) Serialize() ([]byte, error) {
-	buf.Reset()
+	buf := new(bytes.Buffer)
 	err := binary.Write(buf, binary.LittleEndian, hbm.Timestamp)
 	if err != nil {
 		return nil, err
@@ -125,7 +131,8 @@ func DeserializeHeartBeat(data []byte) (message Message, err error) {
 	}, nil
 }
 
-// HandleHeartBeat updates connection heart beat timestamp.
+// HandleHeartBeat updates connection heart beat timestamp. It is not necessary
+// with HeartbeatOption, which handles heart beats itself.
 func HandleHeartBeat(ctx context.Context, c WriteCloser) {
 	msg := MessageFromContext(ctx)
 	switch c := c.(type) {
@@ -145,10 +152,20 @@ type Codec interface {
 
 // TypeLengthValueCodec defines a special codec.
 // Format: type-length-value |4 bytes|4 bytes|n bytes <= 8M|
-type TypeLengthValueCodec struct{}
+// Messages are unmarshaled by functions registered on Router, or DefaultRouter
+// if it is nil.
+type TypeLengthValueCodec struct {
+	Router *Router
+}
 
 // Decode decodes the bytes data into Message
 func (codec TypeLengthValueCodec) Decode(raw net.Conn) (Message, error) {
+	return codec.DecodeVersion(raw, 0)
+}
+
+// DecodeVersion decodes the bytes data sent by peer speaking version into
+// Message, see VersionOption.
+func (codec TypeLengthValueCodec) DecodeVersion(raw net.Conn, version uint32) (Message, error) {
 	byteChan := make(chan []byte)
 	errorChan := make(chan error)
 
@@ -201,7 +218,17 @@ func (codec TypeLengthValueCodec) Decode(raw net.Conn) (Message, error) {
 			return nil, err
 		}
 		// deserialize message from bytes
-		unmarshaler := GetUnmarshalFunc(msgType)
+		unmarshaler := routerOf(codec.Router).VersionUnmarshalFunc(msgType, version)
+		if unmarshaler == nil {
+			switch msgType {
+			case HeartBeat:
+				unmarshaler = DeserializeHeartBeat
+			case ErrorMessageNumber:
+				unmarshaler = DeserializeErrorMessage
+			case VersionMessageNumber:
+				unmarshaler = DeserializeVersionMessage
+			}
+		}
 		if unmarshaler == nil {
 			return nil, ErrUndefined(msgType)
 		}
@@ -227,11 +254,13 @@ func (codec TypeLengthValueCodec) Encode(msg Message) ([]byte, error) {
 // ContextKey is the key type for putting context-related data.
 type contextKey string
 
-// Context keys for messge, server and net ID.
+// Context keys for messge, server, net ID and principal.
 const (
-	messageCtx contextKey = "message"
-	serverCtx  contextKey = "server"
-	netIDCtx   contextKey = "netid"
+	messageCtx   contextKey = "message"
+	serverCtx    contextKey = "server"
+	netIDCtx     contextKey = "netid"
+	principalCtx contextKey = "principal"
+	groupCtx     contextKey = "group"
 )
 
 // NewContextWithMessage returns a new Context that carries message.
@@ -12,6 +12,9 @@ var (
 	connExported   *expvar.Int
 	timeExported   *expvar.Float
 	qpsExported    *expvar.Float
+	deniedExported *expvar.Int
+	rejectExported *expvar.Int
+	saturExported  *expvar.Int
 )
 
 func init() {
@@ -19,6 +22,9 @@ func init() {
 	connExported = expvar.NewInt("TotalConn")
 	timeExported = expvar.NewFloat("TotalTime")
 	qpsExported = expvar.NewFloat("QPS")
+	deniedExported = expvar.NewInt("TotalDenied")
+	rejectExported = expvar.NewInt("TotalRejected")
+	saturExported = expvar.NewInt("TotalSaturated")
 }
 
 // MonitorOn starts up an HTTP monitor on port.
@@ -40,6 +46,19 @@ func addTotalHandle() {
 	calculateQPS()
 }
 
+func addTotalDenied() {
+	deniedExported.Add(1)
+}
+
+func addTotalRejected() {
+	rejectExported.Add(1)
+}
+
+// addTotalSaturated counts the times reading paused for full queues.
+func addTotalSaturated() {
+	saturExported.Add(1)
+}
+
 func addTotalTime(seconds float64) {
 	timeExported.Add(seconds)
 	calculateQPS()
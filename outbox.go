@@ -0,0 +1,177 @@
+package tao
+
+import (
+	"sync"
+	"time"
+)
+
+// OutboxOption returns a ServerOption that makes ClientConn keep unsent messages
+// in a bounded outbox of size while disconnected, and replay them in order on
+// the reconnected connection. Messages older than ttl, 0 means forever, are
+// dropped and passed to onExpire if not nil, so are the messages left when the
+// connection is closed by user or gives up reconnecting, after which writes
+// fail with ErrConnClosed. It works with ReconnectOption.
+func OutboxOption(size int, ttl time.Duration, onExpire func(Message)) ServerOption {
+	return func(o *options) {
+		o.outboxSize = size
+		o.outboxTTL = ttl
+		o.onExpire = onExpire
+	}
+}
+
+// outbox holds outbound messages of ClientConn across reconnects. When online
+// messages go straight to the send queue of the current connection.
+type outbox struct {
+	size     int
+	ttl      time.Duration
+	onExpire func(Message)
+	mu       sync.Mutex // guards following
+	sendQ    *priorityQueue[writeData]
+	items    []writeData
+	closed   bool
+}
+
+func newOutbox(size int, ttl time.Duration, onExpire func(Message)) *outbox {
+	return &outbox{
+		size:     size,
+		ttl:      ttl,
+		onExpire: onExpire,
+		items:    []writeData{},
+	}
+}
+
+// write queues an encoded message, it expires after ttl if not sent.
+func (ob *outbox) write(codec Codec, msg Message, p Priority, ttl time.Duration, cbRes chan bool) error {
+	pkt, err := codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	wd := writeData{
+		data:  pkt,
+		cbRes: cbRes,
+		msg:   msg,
+	}
+	if ttl > 0 {
+		wd.expire = time.Now().Add(ttl).UnixNano()
+	}
+
+	ob.mu.Lock()
+	if ob.closed {
+		ob.mu.Unlock()
+		return ErrConnClosed
+	}
+	if ob.sendQ != nil {
+		defer ob.mu.Unlock()
+		if !ob.sendQ.tryPush(p, wd) {
+			return ErrWouldBlock
+		}
+		return nil
+	}
+	expired := ob.purge()
+	if len(ob.items) >= ob.size {
+		err = ErrWouldBlock
+	} else {
+		ob.items = append(ob.items, wd)
+	}
+	ob.mu.Unlock()
+
+	ob.expire(expired)
+	return err
+}
+
+// replay writes messages queued in order, and then attaches sendQ so that
+// following messages go there directly.
+func (ob *outbox) replay(write func(writeData) error, sendQ *priorityQueue[writeData]) error {
+	for {
+		ob.mu.Lock()
+		expired := ob.purge()
+		if len(ob.items) == 0 {
+			ob.sendQ = sendQ
+			ob.mu.Unlock()
+			ob.expire(expired)
+			return nil
+		}
+		wd := ob.items[0]
+		ob.items = ob.items[1:]
+		ob.mu.Unlock()
+		ob.expire(expired)
+
+		if err := write(wd); err != nil {
+			ob.mu.Lock()
+			ob.items = append([]writeData{wd}, ob.items...)
+			ob.mu.Unlock()
+			return err
+		}
+		if wd.cbRes != nil {
+			wd.cbRes <- true
+		}
+	}
+}
+
+// detach takes messages back from sendQ when connection lost, failed is the
+// one failed to be written, if any.
+func (ob *outbox) detach(sendQ *priorityQueue[writeData], failed *writeData) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	ob.sendQ = nil
+
+	pending := []writeData{}
+	if failed != nil {
+		pending = append(pending, *failed)
+	}
+	for {
+		wd, ok := sendQ.tryPop()
+		if !ok {
+			ob.items = append(pending, ob.items...)
+			return
+		}
+		pending = append(pending, wd)
+	}
+}
+
+// close drops all the messages queued, passing them to onExpire, and fails
+// following writes.
+func (ob *outbox) close() {
+	ob.mu.Lock()
+	ob.closed = true
+	dropped := ob.items
+	ob.items = nil
+	ob.mu.Unlock()
+	ob.expire(dropped)
+}
+
+// isClosed tells whether outbox has been closed.
+func (ob *outbox) isClosed() bool {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	return ob.closed
+}
+
+// purge removes expired messages, it must be called with ob.mu held.
+func (ob *outbox) purge() []writeData {
+	now := time.Now().UnixNano()
+	var expired []writeData
+	kept := ob.items[:0]
+	for _, wd := range ob.items {
+		if wd.expire != 0 && now > wd.expire {
+			expired = append(expired, wd)
+			continue
+		}
+		kept = append(kept, wd)
+	}
+	ob.items = kept
+	return expired
+}
+
+// expire fails the writers waiting for messages dropped, and passes them to
+// onExpire.
+func (ob *outbox) expire(dropped []writeData) {
+	for _, wd := range dropped {
+		if wd.cbRes != nil {
+			wd.cbRes <- false
+		}
+		if ob.onExpire != nil {
+			ob.onExpire(wd.msg)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package tao
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type outboxMessage int
+
+func (m outboxMessage) MessageNumber() int32 { return 1 }
+
+func (m outboxMessage) Serialize() ([]byte, error) { return []byte{byte(m)}, nil }
+
+// replayed replays ob into a new send queue, returning messages written.
+func replayed(t *testing.T, ob *outbox) ([]Message, *priorityQueue[writeData]) {
+	t.Helper()
+	var msgs []Message
+	sendQ := newPriorityQueue[writeData](8, StrictPriority)
+	err := ob.replay(func(wd writeData) error {
+		msgs = append(msgs, wd.msg)
+		return nil
+	}, sendQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs, sendQ
+}
+
+func TestOutboxBounded(t *testing.T) {
+	ob := newOutbox(2, 0, nil)
+	codec := TypeLengthValueCodec{}
+	for i := 0; i < 2; i++ {
+		if err := ob.write(codec, outboxMessage(i), PriorityNormal, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ob.write(codec, outboxMessage(2), PriorityNormal, 0, nil); err != ErrWouldBlock {
+		t.Fatalf("write to full outbox got %v, want ErrWouldBlock", err)
+	}
+}
+
+func TestOutboxReplayInOrder(t *testing.T) {
+	ob := newOutbox(8, 0, nil)
+	codec := TypeLengthValueCodec{}
+	for i := 0; i < 3; i++ {
+		ob.write(codec, outboxMessage(i), PriorityNormal, 0, nil)
+	}
+	msgs, sendQ := replayed(t, ob)
+	for i, m := range msgs {
+		if m != outboxMessage(i) {
+			t.Fatalf("replayed %v, want in order", msgs)
+		}
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("replayed %d messages, want 3", len(msgs))
+	}
+
+	// online now, messages go to the send queue directly
+	ob.write(codec, outboxMessage(3), PriorityNormal, 0, nil)
+	if wd, ok := sendQ.tryPop(); !ok || wd.msg != outboxMessage(3) {
+		t.Fatalf("got %v from send queue, want message 3", wd.msg)
+	}
+}
+
+func TestOutboxReplayFailed(t *testing.T) {
+	ob := newOutbox(8, 0, nil)
+	codec := TypeLengthValueCodec{}
+	for i := 0; i < 3; i++ {
+		ob.write(codec, outboxMessage(i), PriorityNormal, 0, nil)
+	}
+	written := 0
+	err := ob.replay(func(wd writeData) error {
+		if wd.msg == outboxMessage(1) {
+			return errors.New("broken pipe")
+		}
+		written++
+		return nil
+	}, newPriorityQueue[writeData](8, StrictPriority))
+	if err == nil || written != 1 {
+		t.Fatalf("replay got (%v, %d written), want error after 1", err, written)
+	}
+	// the failed one is kept ahead of the rest
+	msgs, _ := replayed(t, ob)
+	if len(msgs) != 2 || msgs[0] != outboxMessage(1) || msgs[1] != outboxMessage(2) {
+		t.Fatalf("replayed %v, want [1 2]", msgs)
+	}
+}
+
+func TestOutboxExpire(t *testing.T) {
+	var expired []Message
+	ob := newOutbox(8, 0, func(m Message) { expired = append(expired, m) })
+	codec := TypeLengthValueCodec{}
+	ob.write(codec, outboxMessage(0), PriorityNormal, time.Millisecond, nil)
+	ob.write(codec, outboxMessage(1), PriorityNormal, 0, nil)
+	time.Sleep(5 * time.Millisecond)
+
+	msgs, _ := replayed(t, ob)
+	if len(msgs) != 1 || msgs[0] != outboxMessage(1) {
+		t.Fatalf("replayed %v, want [1]", msgs)
+	}
+	if len(expired) != 1 || expired[0] != outboxMessage(0) {
+		t.Fatalf("expired %v, want [0]", expired)
+	}
+}
+
+func TestOutboxDetach(t *testing.T) {
+	ob := newOutbox(8, 0, nil)
+	codec := TypeLengthValueCodec{}
+	_, sendQ := replayed(t, ob)
+	for i := 1; i < 3; i++ {
+		ob.write(codec, outboxMessage(i), PriorityNormal, 0, nil)
+	}
+
+	// message 0 failed to be written when connection lost
+	ob.detach(sendQ, &writeData{msg: outboxMessage(0)})
+	ob.write(codec, outboxMessage(3), PriorityNormal, 0, nil)
+	if sendQ.Len() != 0 {
+		t.Fatal("written to send queue detached")
+	}
+
+	msgs, _ := replayed(t, ob)
+	for i, m := range msgs {
+		if m != outboxMessage(i) {
+			t.Fatalf("replayed %v, want [0 1 2 3]", msgs)
+		}
+	}
+	if len(msgs) != 4 {
+		t.Fatalf("replayed %d messages, want 4", len(msgs))
+	}
+}
+
+func TestOutboxClose(t *testing.T) {
+	var expired []Message
+	ob := newOutbox(8, 0, func(m Message) { expired = append(expired, m) })
+	codec := TypeLengthValueCodec{}
+	cbRes := make(chan bool, 1)
+	ob.write(codec, outboxMessage(0), PriorityNormal, 0, nil)
+	ob.write(codec, outboxMessage(1), PriorityNormal, 0, cbRes)
+
+	ob.close()
+	if len(expired) != 2 || expired[0] != outboxMessage(0) || expired[1] != outboxMessage(1) {
+		t.Fatalf("expired %v, want [0 1]", expired)
+	}
+	if sent := <-cbRes; sent {
+		t.Fatal("message dropped reported as sent")
+	}
+	if err := ob.write(codec, outboxMessage(2), PriorityNormal, 0, nil); err != ErrConnClosed {
+		t.Fatalf("write to closed outbox got %v, want ErrConnClosed", err)
+	}
+	if msgs, _ := replayed(t, ob); len(msgs) != 0 {
+		t.Fatalf("replayed %v from closed outbox", msgs)
+	}
+}
+
+func TestOutboxExpireWriteByRes(t *testing.T) {
+	ob := newOutbox(8, 0, nil)
+	cbRes := make(chan bool, 1)
+	ob.write(TypeLengthValueCodec{}, outboxMessage(0), PriorityNormal, time.Millisecond, cbRes)
+	time.Sleep(5 * time.Millisecond)
+	replayed(t, ob)
+	if sent := <-cbRes; sent {
+		t.Fatal("message expired reported as sent")
+	}
+}
+
+// outboxLen returns the number of messages queued in ob.
+func outboxLen(ob *outbox) int {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	return len(ob.items)
+}
+
+func TestClientCloseDropsOutbox(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	expired := make(chan Message, 8)
+	cc := NewClientConn(1, client, OutboxOption(8, 0, func(m Message) { expired <- m }))
+	// not started, messages are kept in outbox
+	cc.Write(outboxMessage(0))
+	res := make(chan error, 1)
+	go func() { res <- cc.WriteByRes(outboxMessage(1)) }()
+	for outboxLen(cc.opts.outbox) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cc.Close()
+	if n := len(expired); n != 2 {
+		t.Fatalf("%d messages expired on Close, want 2", n)
+	}
+	select {
+	case err := <-res:
+		if err != ErrConnClosed {
+			t.Fatalf("WriteByRes got %v, want ErrConnClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WriteByRes blocked after Close")
+	}
+	if err := cc.Write(outboxMessage(2)); err != ErrConnClosed {
+		t.Fatalf("Write after Close got %v, want ErrConnClosed", err)
+	}
+	if err := cc.WriteWithTTL(outboxMessage(3), time.Second); err != ErrConnClosed {
+		t.Fatalf("WriteWithTTL after Close got %v, want ErrConnClosed", err)
+	}
+}
+
+func TestGaveUpDropsOutbox(t *testing.T) {
+	client, server := net.Pipe()
+	expired := make(chan Message, 8)
+	gaveUp := make(chan struct{})
+	cc := NewClientConn(1, client,
+		OutboxOption(8, 0, func(m Message) { expired <- m }),
+		ReconnectOption(),
+		DialerOption(func(context.Context, string, string) (net.Conn, error) {
+			return nil, errors.New("refused")
+		}),
+		ReconnectBackoffOption(Backoff{Initial: time.Millisecond, MaxAttempts: 1}),
+		OnReconnectOption(func(_ WriteCloser, s ReconnectState) {
+			if s == StateGaveUp {
+				close(gaveUp)
+			}
+		}),
+	)
+	defer cc.Close()
+	cc.Start()
+
+	// peer never reads, messages are taken back into outbox when lost
+	for i := 0; i < 3; i++ {
+		cc.Write(outboxMessage(i))
+	}
+	server.Close()
+	select {
+	case <-gaveUp:
+	case <-time.After(time.Second):
+		t.Fatal("never gave up")
+	}
+	if n := len(expired); n != 3 {
+		t.Fatalf("%d messages expired after gave up, want 3", n)
+	}
+	if err := cc.Write(outboxMessage(3)); err != ErrConnClosed {
+		t.Fatalf("Write after gave up got %v, want ErrConnClosed", err)
+	}
+}
@@ -0,0 +1,92 @@
+package tao
+
+import (
+	"fmt"
+)
+
+// PanicPolicy decides what to do when a handler, onMessage or timer callback
+// panics.
+type PanicPolicy int
+
+// Policies applied by PanicPolicyOption.
+const (
+	// PanicKeep recovers and keeps the connection open, it is the default.
+	PanicKeep PanicPolicy = iota
+	// PanicClose recovers and closes the connection.
+	PanicClose
+	// PanicCrash re-panics so that the process crashes.
+	PanicCrash
+)
+
+func (p PanicPolicy) String() string {
+	switch p {
+	case PanicKeep:
+		return "keep"
+	case PanicClose:
+		return "close"
+	case PanicCrash:
+		return "crash"
+	}
+	return "unknown"
+}
+
+// PanicPolicyOption returns a ServerOption that sets what to do when a handler,
+// the onMessage callback or a timer callback panics. The panic is logged with
+// its stack and reported to OnConnErrorOption as ErrorPanic in any case.
+func PanicPolicyOption(policy PanicPolicy) ServerOption {
+	return func(o *options) {
+		o.panicPolicy = policy
+	}
+}
+
+// fatalPanic is re-panicked under PanicCrash, it passes through the recovers in
+// WorkerPool and connection go-routines.
+type fatalPanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (p fatalPanic) Error() string {
+	return fmt.Sprintf("%v\n%s", p.value, p.stack)
+}
+
+// recoverCallback recovers a panic in callback of c, it must be called
+// directly by defer.
+func recoverCallback(c WriteCloser, msgType int32) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	if _, ok := p.(fatalPanic); ok {
+		panic(p)
+	}
+	stack := stackTrace()
+
+	var (
+		policy PanicPolicy
+		logger LoggerInterface
+	)
+	switch c := c.(type) {
+	case *ServerConn:
+		policy = c.belong.opts.panicPolicy
+		logger = c.logger
+	case *ClientConn:
+		policy = c.opts.panicPolicy
+		logger = c.logger
+	}
+
+	if logger != nil {
+		logger.Errorf("panics in handling message %d: %v\n%s", msgType, p, stack)
+	} else {
+		printStack()
+	}
+	reportError(c, ErrorPanic, msgType, fmt.Errorf("panic: %v", p))
+
+	switch policy {
+	case PanicClose:
+		// not to block the worker waiting for connection go-routines
+		go closeConn(c)
+	case PanicCrash:
+		panic(fatalPanic{value: p, stack: stack})
+	}
+}
@@ -0,0 +1,123 @@
+package tao
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// panicServer connects to a server of policy where textMessage "panic" panics,
+// in its handler or the onMessage callback. Messages not panicking are sent to
+// handled, panics reported to errs, and closed is closed with the connection.
+func panicServer(t *testing.T, policy PanicPolicy, onMessage bool) (conn net.Conn, handled <-chan string, errs <-chan *ConnError, closed <-chan struct{}) {
+	t.Helper()
+	handledCh := make(chan string, 1)
+	handle := func(m *textMessage) {
+		if m.Text == "panic" {
+			panic("panic in handling")
+		}
+		handledCh <- m.Text
+	}
+	r := NewRouter()
+	opts := []ServerOption{RouterOption(r), PanicPolicyOption(policy)}
+	if onMessage {
+		r.Register(textMessageNumber, func(data []byte) (Message, error) {
+			return &textMessage{Text: string(data)}, nil
+		}, nil)
+		opts = append(opts, OnMessageOption(func(m Message, _ WriteCloser) { handle(m.(*textMessage)) }))
+	} else {
+		Handle(r, textMessageNumber, func(_ context.Context, m *textMessage, _ WriteCloser) error {
+			handle(m)
+			return nil
+		})
+	}
+	errsCh := make(chan *ConnError, 1)
+	closedCh := make(chan struct{})
+	opts = append(opts,
+		OnConnErrorOption(func(_ WriteCloser, err *ConnError) {
+			if err.Kind == ErrorPanic {
+				errsCh <- err
+			}
+		}),
+		OnCloseOption(func(WriteCloser) { close(closedCh) }),
+	)
+	_, addr := startServer(t, opts...)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, handledCh, errsCh, closedCh
+}
+
+// expectPanic waits for a panic in handling textMessage reported.
+func expectPanic(t *testing.T, errs <-chan *ConnError) {
+	t.Helper()
+	select {
+	case err := <-errs:
+		if err.MessageNumber != textMessageNumber {
+			t.Fatalf("panic reported on message %d, want %d", err.MessageNumber, textMessageNumber)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("panic not reported")
+	}
+}
+
+func TestPanicKeep(t *testing.T) {
+	for _, onMessage := range []bool{false, true} {
+		conn, handled, errs, closed := panicServer(t, PanicKeep, onMessage)
+		writeFrame(t, conn, &textMessage{Text: "panic"})
+		expectPanic(t, errs)
+
+		writeFrame(t, conn, &textMessage{Text: "next"})
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatalf("onMessage %t: message after panic not handled", onMessage)
+		}
+		select {
+		case <-closed:
+			t.Fatalf("onMessage %t: connection closed", onMessage)
+		default:
+		}
+	}
+}
+
+func TestPanicClose(t *testing.T) {
+	for _, onMessage := range []bool{false, true} {
+		conn, _, errs, closed := panicServer(t, PanicClose, onMessage)
+		writeFrame(t, conn, &textMessage{Text: "panic"})
+		expectPanic(t, errs)
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatalf("onMessage %t: connection not closed", onMessage)
+		}
+	}
+}
+
+func TestPanicCrash(t *testing.T) {
+	if mode := os.Getenv("TAO_PANIC_CRASH"); mode != "" {
+		// in the process expected to crash
+		conn, _, _, _ := panicServer(t, PanicCrash, mode == "onMessage")
+		writeFrame(t, conn, &textMessage{Text: "panic"})
+		time.Sleep(time.Second)
+		return
+	}
+
+	for _, mode := range []string{"handler", "onMessage"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestPanicCrash$")
+		cmd.Env = append(os.Environ(), "TAO_PANIC_CRASH="+mode)
+		out, err := cmd.CombinedOutput()
+		if _, ok := err.(*exec.ExitError); !ok {
+			t.Fatalf("%s: process exited with %v, want crashed", mode, err)
+		}
+		if !strings.Contains(string(out), "panic in handling") {
+			t.Fatalf("%s: crashed without the panic:\n%s", mode, out)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package tao
+
+// Priority is the priority level of message, higher ones are written and
+// handled first.
+type Priority int
+
+// Priority levels, the zero value is PriorityNormal.
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+)
+
+// numPriorities is the number of priority levels.
+const numPriorities = 3
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return "unknown"
+}
+
+// level returns the index of queue for p, 0 for the highest.
+func (p Priority) level() int {
+	switch {
+	case p >= PriorityHigh:
+		return 0
+	case p <= PriorityLow:
+		return 2
+	}
+	return 1
+}
+
+// Scheduling decides how queues of different priorities are served.
+type Scheduling int
+
+const (
+	// StrictPriority always serves higher priority first, lower ones may
+	// starve under constant load of higher ones. It is the default.
+	StrictPriority Scheduling = iota
+	// WeightedFair serves high, normal and low priorities by the ratio of
+	// 4:2:1 when all of them are backlogged, so none starves.
+	WeightedFair
+)
+
+// fairWeights is the number of items served per round for each level.
+var fairWeights = [numPriorities]int{4, 2, 1}
+
+// SchedulingOption returns a ServerOption that sets how outbound and inbound
+// messages of different priorities are scheduled.
+func SchedulingOption(sched Scheduling) ServerOption {
+	return func(o *options) {
+		o.scheduling = sched
+	}
+}
+
+// PriorityOption returns a RegisterOption that sets the default priority of
+// message, in both directions. Messages only sent can be declared by calling
+// Register with nil unmarshaler and handler.
+func PriorityOption(p Priority) RegisterOption {
+	return func(h *handlerUnmarshaler) {
+		h.priority = p
+	}
+}
+
+// priorityOf returns the priority declared for msg on r.
+func priorityOf(r *Router, msg Message) Priority {
+	if msg == nil {
+		return PriorityNormal
+	}
+	return routerOf(r).Priority(msg.MessageNumber())
+}
+
+// priorityQueue is a bounded queue of one channel per priority level, it has
+// one consumer and many producers.
+type priorityQueue[T any] struct {
+	chans  [numPriorities]chan T
+	notify chan struct{} // signaled when items may be available
+	sched  Scheduling
+	credit [numPriorities]int // accessed by consumer only
+}
+
+// newPriorityQueue returns a queue holding size items of normal priority, so
+// traffic not prioritized has the full size as without priorities. High and
+// low priorities have their own queues of a quarter of size each.
+func newPriorityQueue[T any](size int, sched Scheduling) *priorityQueue[T] {
+	q := &priorityQueue[T]{
+		notify: make(chan struct{}, 1),
+		sched:  sched,
+		credit: fairWeights,
+	}
+	if size < 1 {
+		size = 1
+	}
+	side := size / 4
+	if side < 1 {
+		side = 1
+	}
+	q.chans[PriorityHigh.level()] = make(chan T, side)
+	q.chans[PriorityNormal.level()] = make(chan T, size)
+	q.chans[PriorityLow.level()] = make(chan T, side)
+	return q
+}
+
+// tryPush queues v without blocking, it returns false if the queue of p is full.
+func (q *priorityQueue[T]) tryPush(p Priority, v T) bool {
+	select {
+	case q.chans[p.level()] <- v:
+		q.signal()
+		return true
+	default:
+		return false
+	}
+}
+
+// push queues v, blocking until there is room or any of done is closed.
+func (q *priorityQueue[T]) push(p Priority, v T, cDone, sDone <-chan struct{}) bool {
+	select {
+	case q.chans[p.level()] <- v:
+		q.signal()
+		return true
+	case <-cDone:
+		return false
+	case <-sDone:
+		return false
+	}
+}
+
+// signal wakes up the consumer waiting on wait.
+func (q *priorityQueue[T]) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// wait returns a channel receiving when items may be available, for consumer
+// selecting on other channels too, it should call tryPop then.
+func (q *priorityQueue[T]) wait() <-chan struct{} {
+	return q.notify
+}
+
+// tryPop takes the next item by scheduling without blocking.
+func (q *priorityQueue[T]) tryPop() (T, bool) {
+	v, ok := q.take()
+	if ok && q.Len() > 0 {
+		// keep consumer waking up for the rest
+		q.signal()
+	}
+	return v, ok
+}
+
+func (q *priorityQueue[T]) take() (T, bool) {
+	if q.sched == WeightedFair {
+		for i := range q.chans {
+			if q.credit[i] > 0 {
+				if v, ok := q.recv(i); ok {
+					q.credit[i]--
+					return v, true
+				}
+			}
+		}
+		// levels with credits left are empty, start a new round
+		q.credit = fairWeights
+	}
+	for i := range q.chans {
+		if v, ok := q.recv(i); ok {
+			if q.credit[i] > 0 {
+				q.credit[i]--
+			}
+			return v, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// pop takes the next item by scheduling, blocking until there is one or any
+// of done is closed.
+func (q *priorityQueue[T]) pop(cDone, sDone <-chan struct{}) (T, bool) {
+	for {
+		if v, ok := q.tryPop(); ok {
+			return v, true
+		}
+		select {
+		case <-q.notify:
+		case <-cDone:
+			var zero T
+			return zero, false
+		case <-sDone:
+			var zero T
+			return zero, false
+		}
+	}
+}
+
+func (q *priorityQueue[T]) recv(level int) (T, bool) {
+	select {
+	case v, ok := <-q.chans[level]:
+		return v, ok
+	default:
+		var zero T
+		return zero, false
+	}
+}
+
+// Len returns the number of items queued.
+func (q *priorityQueue[T]) Len() int {
+	n := 0
+	for _, ch := range q.chans {
+		n += len(ch)
+	}
+	return n
+}
+
+// close closes the queue, pushing to it panics afterwards.
+func (q *priorityQueue[T]) close() {
+	for _, ch := range q.chans {
+		close(ch)
+	}
+}
@@ -0,0 +1,78 @@
+package tao
+
+import (
+	"testing"
+)
+
+func TestPriorityQueueCapacity(t *testing.T) {
+	for _, tc := range []struct {
+		size, normal, side int
+	}{
+		{0, 1, 1},
+		{1, 1, 1},
+		{3, 3, 1},
+		{8, 8, 2},
+		{1024, 1024, 256},
+	} {
+		q := newPriorityQueue[int](tc.size, StrictPriority)
+		total := 0
+		for _, p := range []Priority{PriorityHigh, PriorityNormal, PriorityLow} {
+			n := 0
+			for q.tryPush(p, n) {
+				n++
+			}
+			want := tc.side
+			if p == PriorityNormal {
+				want = tc.normal
+			}
+			if n != want {
+				t.Fatalf("size %d: %d items of %v priority, want %d", tc.size, n, p, want)
+			}
+			total += n
+		}
+		if q.Len() != total {
+			t.Fatalf("size %d: Len %d, want %d", tc.size, q.Len(), total)
+		}
+	}
+}
+
+// fillLevels pushes n items of each priority, valued by its priority.
+func fillLevels(q *priorityQueue[Priority], n int) {
+	for i := 0; i < n; i++ {
+		q.tryPush(PriorityLow, PriorityLow)
+		q.tryPush(PriorityNormal, PriorityNormal)
+		q.tryPush(PriorityHigh, PriorityHigh)
+	}
+}
+
+func TestPriorityQueueStrict(t *testing.T) {
+	q := newPriorityQueue[Priority](64, StrictPriority)
+	fillLevels(q, 8)
+	last := PriorityHigh
+	for i := 0; i < 24; i++ {
+		p, ok := q.tryPop()
+		if !ok {
+			t.Fatalf("pop %d: queue empty", i)
+		}
+		if p > last {
+			t.Fatalf("pop %d: %v served after %v", i, p, last)
+		}
+		last = p
+	}
+	if _, ok := q.tryPop(); ok {
+		t.Fatal("popped from empty queue")
+	}
+}
+
+func TestPriorityQueueWeightedFair(t *testing.T) {
+	q := newPriorityQueue[Priority](64, WeightedFair)
+	fillLevels(q, 8)
+	served := map[Priority]int{}
+	for i := 0; i < 7; i++ {
+		p, _ := q.tryPop()
+		served[p]++
+	}
+	if served[PriorityHigh] != 4 || served[PriorityNormal] != 2 || served[PriorityLow] != 1 {
+		t.Fatalf("served %v in a round, want 4:2:1", served)
+	}
+}
@@ -0,0 +1,196 @@
+package tao
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout is the time allowed for reading PROXY protocol header.
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLen is the maximum length of a v1 header including CRLF.
+	proxyV1MaxLen = 107
+)
+
+var (
+	// proxyV1Sig is the prefix of every v1 header.
+	proxyV1Sig = []byte("PROXY ")
+	// proxyV2Sig is the signature preceding every v2 header.
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ProxyProtocolOption returns a ServerOption that makes server read a PROXY
+// protocol v1 or v2 header on every accepted connection, so the original source
+// and destination addresses behind a load balancer are reported by RemoteAddr
+// and LocalAddr, and used by admission rules and rate limits.
+func ProxyProtocolOption() ServerOption {
+	return func(o *options) {
+		o.proxyProtocol = true
+	}
+}
+
+// proxyConn is a net.Conn carrying addresses from PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// SetLinger sets the linger of the underlying TCP connection.
+func (c *proxyConn) SetLinger(sec int) error {
+	if l, ok := c.Conn.(lingerer); ok {
+		return l.SetLinger(sec)
+	}
+	return nil
+}
+
+// lingerer is implemented by *net.TCPConn and connections wrapping it.
+type lingerer interface {
+	SetLinger(int) error
+}
+
+// readProxyHeader reads PROXY protocol header from c within timeout, returning
+// a net.Conn reporting the addresses carried.
+func readProxyHeader(c net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		defer c.SetReadDeadline(time.Time{})
+	}
+
+	pc := &proxyConn{
+		Conn: c,
+		r:    bufio.NewReader(c),
+	}
+	// peek no more than needed to tell the versions apart, a v1 header may
+	// be shorter than the v2 signature.
+	first, err := pc.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	read, sig := pc.readV1, proxyV1Sig
+	if first[0] == proxyV2Sig[0] {
+		read, sig = pc.readV2, proxyV2Sig
+	}
+	prefix, err := pc.r.Peek(len(sig))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(prefix, sig) {
+		return nil, ErrBadProxyHeader
+	}
+	if err = read(); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 parses the human-readable header such as
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n".
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrBadProxyHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return ErrBadProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return ErrBadProxyHeader
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return ErrBadProxyHeader
+	}
+	c.remote = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	c.local = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return nil
+}
+
+// readV2 parses the binary header, TLVs following the addresses are skipped.
+func (c *proxyConn) readV2() error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return err
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if verCmd>>4 != 2 {
+		return ErrBadProxyHeader
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	switch verCmd & 0x0f {
+	case 0x00: // LOCAL, health checks from the balancer itself
+		return nil
+	case 0x01: // PROXY
+	default:
+		return ErrBadProxyHeader
+	}
+
+	var ipLen int
+	switch fam >> 4 {
+	case 0x1: // AF_INET
+		ipLen = net.IPv4len
+	case 0x2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC or AF_UNIX, keep the real addresses
+		return nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return ErrBadProxyHeader
+	}
+	srcIP := net.IP(payload[:ipLen])
+	dstIP := net.IP(payload[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(payload[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(payload[2*ipLen+2:])
+	c.remote = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	c.local = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return nil
+}
@@ -0,0 +1,83 @@
+package tao
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// readHeader writes header to one end of a pipe, keeping it open, and reads
+// PROXY protocol header from the other end.
+func readHeader(t *testing.T, header []byte) (net.Conn, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go client.Write(header)
+	return readProxyHeader(server, time.Second)
+}
+
+func TestProxyV1(t *testing.T) {
+	pc, err := readHeader(t, []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pc.RemoteAddr().String(); got != "192.168.0.1:56324" {
+		t.Errorf("remote %s, want 192.168.0.1:56324", got)
+	}
+	if got := pc.LocalAddr().String(); got != "192.168.0.11:443" {
+		t.Errorf("local %s, want 192.168.0.11:443", got)
+	}
+}
+
+func TestProxyV1UnknownOnly(t *testing.T) {
+	// the shortest header, sent alone by health checks
+	start := time.Now()
+	if _, err := readHeader(t, []byte("PROXY UNKNOWN\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("header read in %v, stalled", d)
+	}
+}
+
+func TestProxyV2(t *testing.T) {
+	header := append([]byte{}, proxyV2Sig...)
+	header = append(header, 0x21, 0x11) // version 2 PROXY, AF_INET over TCP
+	header = binary.BigEndian.AppendUint16(header, 12)
+	header = append(header, 10, 0, 0, 1, 10, 0, 0, 2)
+	header = binary.BigEndian.AppendUint16(header, 1234)
+	header = binary.BigEndian.AppendUint16(header, 80)
+	pc, err := readHeader(t, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pc.RemoteAddr().String(); got != "10.0.0.1:1234" {
+		t.Errorf("remote %s, want 10.0.0.1:1234", got)
+	}
+	if got := pc.LocalAddr().String(); got != "10.0.0.2:80" {
+		t.Errorf("local %s, want 10.0.0.2:80", got)
+	}
+}
+
+func TestProxyBadHeader(t *testing.T) {
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 bad 192.168.0.11 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+	} {
+		if _, err := readHeader(t, []byte(header)); err != ErrBadProxyHeader {
+			t.Errorf("header %q got %v, want ErrBadProxyHeader", header, err)
+		}
+	}
+}
+
+func TestProxyConnLinger(t *testing.T) {
+	var c net.Conn = &proxyConn{Conn: &net.TCPConn{}}
+	if _, ok := c.(lingerer); !ok {
+		t.Fatal("proxyConn does not forward SetLinger")
+	}
+}
@@ -0,0 +1,231 @@
+package tao
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Topics are dot-separated segments such as "chat.room.42". Subscriptions can
+// use wildcard segments, "*" matches exactly one segment and ">", which must be
+// the last, matches one or more segments.
+const (
+	topicSep          = "."
+	topicWildcard     = "*"
+	topicFullWildcard = ">"
+)
+
+// topicNode is a node of the subscription trie, keyed by segment.
+type topicNode struct {
+	children map[string]*topicNode
+	subs     map[int64]struct{}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children: make(map[string]*topicNode),
+		subs:     make(map[int64]struct{}),
+	}
+}
+
+// pubsub holds topic subscriptions of server connections.
+type pubsub struct {
+	mu     sync.RWMutex // guards following
+	root   *topicNode
+	byConn map[int64]map[string]struct{}
+}
+
+func newPubSub() *pubsub {
+	return &pubsub{
+		root:   newTopicNode(),
+		byConn: make(map[int64]map[string]struct{}),
+	}
+}
+
+// splitTopic splits topic into segments, wildcards are allowed if pattern.
+func splitTopic(topic string, pattern bool) ([]string, error) {
+	segs := strings.Split(topic, topicSep)
+	for i, seg := range segs {
+		switch {
+		case seg == "":
+			return nil, ErrInvalidTopic
+		case seg == topicWildcard:
+			if !pattern {
+				return nil, ErrInvalidTopic
+			}
+		case seg == topicFullWildcard:
+			if !pattern || i != len(segs)-1 {
+				return nil, ErrInvalidTopic
+			}
+		case strings.ContainsAny(seg, topicWildcard+topicFullWildcard):
+			return nil, ErrInvalidTopic
+		}
+	}
+	return segs, nil
+}
+
+func (ps *pubsub) subscribe(netID int64, topic string) error {
+	segs, err := splitTopic(topic, true)
+	if err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	node := ps.root
+	for _, seg := range segs {
+		child, ok := node.children[seg]
+		if !ok {
+			child = newTopicNode()
+			node.children[seg] = child
+		}
+		node = child
+	}
+	node.subs[netID] = struct{}{}
+
+	topics, ok := ps.byConn[netID]
+	if !ok {
+		topics = make(map[string]struct{})
+		ps.byConn[netID] = topics
+	}
+	topics[topic] = struct{}{}
+	return nil
+}
+
+func (ps *pubsub) unsubscribe(netID int64, topic string) {
+	segs, err := splitTopic(topic, true)
+	if err != nil {
+		return
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.remove(ps.root, segs, netID)
+	if topics, ok := ps.byConn[netID]; ok {
+		delete(topics, topic)
+		if len(topics) == 0 {
+			delete(ps.byConn, netID)
+		}
+	}
+}
+
+// remove removes netID from node of segs, pruning empty nodes, it must be
+// called with ps.mu held. It returns true if node becomes empty.
+func (ps *pubsub) remove(node *topicNode, segs []string, netID int64) bool {
+	if len(segs) == 0 {
+		delete(node.subs, netID)
+	} else if child, ok := node.children[segs[0]]; ok {
+		if ps.remove(child, segs[1:], netID) {
+			delete(node.children, segs[0])
+		}
+	}
+	return len(node.subs) == 0 && len(node.children) == 0
+}
+
+// removeConn removes all subscriptions of netID.
+func (ps *pubsub) removeConn(netID int64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for topic := range ps.byConn[netID] {
+		segs, _ := splitTopic(topic, true)
+		ps.remove(ps.root, segs, netID)
+	}
+	delete(ps.byConn, netID)
+}
+
+// topics returns the subscriptions of netID.
+func (ps *pubsub) topics(netID int64) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	topics := make([]string, 0, len(ps.byConn[netID]))
+	for topic := range ps.byConn[netID] {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// match returns net IDs subscribed to topic, each appears once however many
+// patterns it matches.
+func (ps *pubsub) match(topic string) ([]int64, error) {
+	segs, err := splitTopic(topic, false)
+	if err != nil {
+		return nil, err
+	}
+
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	found := make(map[int64]struct{})
+	matchTopic(ps.root, segs, found)
+	ids := make([]int64, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func matchTopic(node *topicNode, segs []string, found map[int64]struct{}) {
+	if len(segs) == 0 {
+		for id := range node.subs {
+			found[id] = struct{}{}
+		}
+		return
+	}
+	if child, ok := node.children[topicFullWildcard]; ok {
+		for id := range child.subs {
+			found[id] = struct{}{}
+		}
+	}
+	if child, ok := node.children[topicWildcard]; ok {
+		matchTopic(child, segs[1:], found)
+	}
+	if child, ok := node.children[segs[0]]; ok {
+		matchTopic(child, segs[1:], found)
+	}
+}
+
+// Subscribe subscribes connection netID to topic, which may contain wildcards.
+// Subscriptions are removed when the connection closes.
+func (s *Server) Subscribe(netID int64, topic string) error {
+	if _, ok := s.conns.Get(netID); !ok {
+		return fmt.Errorf("%w: %d", ErrConnNotFound, netID)
+	}
+	if err := s.pubsub.subscribe(netID, topic); err != nil {
+		return err
+	}
+	// the connection may have closed and cleaned up in between
+	if _, ok := s.conns.Get(netID); !ok {
+		s.pubsub.removeConn(netID)
+		return fmt.Errorf("%w: %d", ErrConnNotFound, netID)
+	}
+	return nil
+}
+
+// Unsubscribe unsubscribes connection netID from topic, it must be the same as
+// subscribed.
+func (s *Server) Unsubscribe(netID int64, topic string) {
+	s.pubsub.unsubscribe(netID, topic)
+}
+
+// Topics returns the topics connection netID subscribed.
+func (s *Server) Topics(netID int64) []string {
+	return s.pubsub.topics(netID)
+}
+
+// Publish sends msg to all connections subscribed to topic, which must not
+// contain wildcards. The message is encoded once and the bytes are shared by
+// all the subscribers. ErrBroadcast is returned if it could not be queued to
+// some of them.
+func (s *Server) Publish(topic string, msg Message) error {
+	ids, err := s.pubsub.match(topic)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	conns := make([]*ServerConn, 0, len(ids))
+	for _, id := range ids {
+		if sc, ok := s.conns.Get(id); ok {
+			conns = append(conns, sc)
+		}
+	}
+	return s.fanout(msg, conns, nil)
+}
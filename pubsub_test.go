@@ -0,0 +1,97 @@
+package tao
+
+import (
+	"sort"
+	"testing"
+)
+
+// matched returns the sorted net IDs subscribed to topic.
+func matched(t *testing.T, ps *pubsub, topic string) []int64 {
+	t.Helper()
+	ids, err := ps.match(topic)
+	if err != nil {
+		t.Fatalf("match %q: %v", topic, err)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPubSubMatch(t *testing.T) {
+	ps := newPubSub()
+	for id, topic := range map[int64]string{
+		1: "chat.room.1",
+		2: "chat.*.1",
+		3: "chat.>",
+		4: ">",
+		5: "chat.room",
+	} {
+		if err := ps.subscribe(id, topic); err != nil {
+			t.Fatalf("subscribe %q: %v", topic, err)
+		}
+	}
+	// matching more patterns is delivered once
+	ps.subscribe(2, "chat.room.1")
+
+	for _, tc := range []struct {
+		topic string
+		want  []int64
+	}{
+		{"chat.room.1", []int64{1, 2, 3, 4}},
+		{"chat.lobby.1", []int64{2, 3, 4}},
+		{"chat.room", []int64{3, 4, 5}},
+		{"chat.room.1.x", []int64{3, 4}},
+		{"chat", []int64{4}},
+		{"news.room.1", []int64{4}},
+	} {
+		if got := matched(t, ps, tc.topic); !equalIDs(got, tc.want) {
+			t.Errorf("match %q got %v, want %v", tc.topic, got, tc.want)
+		}
+	}
+}
+
+func TestPubSubInvalidTopic(t *testing.T) {
+	ps := newPubSub()
+	for _, topic := range []string{"", "a..b", "a.>.b", "a.b*", "a.>x"} {
+		if err := ps.subscribe(1, topic); err != ErrInvalidTopic {
+			t.Errorf("subscribe %q got %v, want ErrInvalidTopic", topic, err)
+		}
+	}
+	for _, topic := range []string{"a.*", "a.>", "a..b"} {
+		if _, err := ps.match(topic); err != ErrInvalidTopic {
+			t.Errorf("match %q got %v, want ErrInvalidTopic", topic, err)
+		}
+	}
+}
+
+func TestPubSubUnsubscribe(t *testing.T) {
+	ps := newPubSub()
+	ps.subscribe(1, "a.b.c")
+	ps.subscribe(1, "a.*")
+	ps.subscribe(2, "a.b.c")
+
+	ps.unsubscribe(1, "a.b.c")
+	if got := matched(t, ps, "a.b.c"); !equalIDs(got, []int64{2}) {
+		t.Fatalf("match after unsubscribed got %v, want [2]", got)
+	}
+	if topics := ps.topics(1); len(topics) != 1 || topics[0] != "a.*" {
+		t.Fatalf("topics of 1 got %v, want [a.*]", topics)
+	}
+
+	ps.removeConn(1)
+	ps.removeConn(2)
+	if len(ps.root.children) != 0 || len(ps.byConn) != 0 {
+		t.Fatal("empty nodes not pruned after connections removed")
+	}
+}
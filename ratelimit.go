@@ -0,0 +1,307 @@
+package tao
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimitPolicy decides what happens to an inbound message exceeding limits.
+type RateLimitPolicy int
+
+// Policies applied when a rate limit is exceeded.
+const (
+	// RateLimitDrop drops the message silently.
+	RateLimitDrop RateLimitPolicy = iota
+	// RateLimitDelay stops reading until a token is available, the message is
+	// processed after the delay.
+	RateLimitDelay
+	// RateLimitDisconnect closes the connection.
+	RateLimitDisconnect
+)
+
+// RateLimitScope tells which limit has been exceeded.
+type RateLimitScope int
+
+// Scopes of rate limits.
+const (
+	RateLimitConn RateLimitScope = iota
+	RateLimitIP
+	RateLimitMessage
+)
+
+func (s RateLimitScope) String() string {
+	switch s {
+	case RateLimitConn:
+		return "connection"
+	case RateLimitIP:
+		return "ip"
+	case RateLimitMessage:
+		return "message"
+	}
+	return "unknown"
+}
+
+// ErrRateLimited is reported to OnConnErrorOption when an inbound message
+// exceeds one of the configured limits, whatever the policy is.
+type ErrRateLimited struct {
+	Scope         RateLimitScope
+	MessageNumber int32
+	// Delay is how long reading stops under RateLimitDelay, 0 if the message
+	// is not processed.
+	Delay time.Duration
+}
+
+func (e ErrRateLimited) Error() string {
+	if e.Delay > 0 {
+		return fmt.Sprintf("message %d exceeds %s rate limit, delayed %v", e.MessageNumber, e.Scope, e.Delay)
+	}
+	return fmt.Sprintf("message %d exceeds %s rate limit", e.MessageNumber, e.Scope)
+}
+
+// rateLimit describes a token bucket, rate tokens are refilled per second
+// up to burst.
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+// ConnRateLimitOption returns a ServerOption that limits inbound messages of
+// every connection to rate per second, allowing bursts of burst messages.
+func ConnRateLimitOption(rate float64, burst int) ServerOption {
+	return func(o *options) {
+		o.connLimit = &rateLimit{rate, burst}
+	}
+}
+
+// IPRateLimitOption returns a ServerOption that limits inbound messages of all
+// connections from the same remote IP to rate per second, allowing bursts of
+// burst messages.
+func IPRateLimitOption(rate float64, burst int) ServerOption {
+	return func(o *options) {
+		o.ipLimit = &rateLimit{rate, burst}
+	}
+}
+
+// MessageRateLimitOption returns a ServerOption that limits inbound messages of
+// msgType on every connection to rate per second, allowing bursts of burst
+// messages.
+func MessageRateLimitOption(msgType int32, rate float64, burst int) ServerOption {
+	return func(o *options) {
+		if o.msgLimits == nil {
+			o.msgLimits = map[int32]rateLimit{}
+		}
+		o.msgLimits[msgType] = rateLimit{rate, burst}
+	}
+}
+
+// RateLimitPolicyOption returns a ServerOption that sets the policy applied when
+// a rate limit is exceeded, the default is RateLimitDrop.
+func RateLimitPolicyOption(policy RateLimitPolicy) ServerOption {
+	return func(o *options) {
+		o.rateLimitPolicy = policy
+	}
+}
+
+// tokenBucket is a go-routine safe token bucket.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit rateLimit) *tokenBucket {
+	burst := float64(limit.burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   limit.rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// take takes one token from bucket. If none is available and reserve is true,
+// the token is borrowed and the duration to wait for it is returned, otherwise
+// take returns false.
+func (tb *tokenBucket) take(reserve bool) (time.Duration, bool) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return 0, true
+	}
+	if !reserve || tb.rate <= 0 {
+		return 0, false
+	}
+	wait := time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+	tb.tokens--
+	return wait, true
+}
+
+// refund gives back a token taken.
+func (tb *tokenBucket) refund() {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.tokens++
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
+
+// ipLimiters shares token buckets among connections from the same IP.
+type ipLimiters struct {
+	mu    sync.Mutex
+	limit rateLimit
+	m     map[string]*ipBucket
+}
+
+type ipBucket struct {
+	bucket *tokenBucket
+	refs   int
+}
+
+func newIPLimiters(limit rateLimit) *ipLimiters {
+	return &ipLimiters{
+		limit: limit,
+		m:     make(map[string]*ipBucket),
+	}
+}
+
+func (l *ipLimiters) acquire(ip string) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.m[ip]
+	if !ok {
+		b = &ipBucket{bucket: newTokenBucket(l.limit)}
+		l.m[ip] = b
+	}
+	b.refs++
+	return b.bucket
+}
+
+func (l *ipLimiters) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.m[ip]; ok {
+		b.refs--
+		if b.refs <= 0 {
+			delete(l.m, ip)
+		}
+	}
+}
+
+// connLimiter applies all the limits configured to one server connection.
+type connLimiter struct {
+	ips    *ipLimiters
+	ip     string
+	conn   *tokenBucket
+	ipb    *tokenBucket
+	limits map[int32]rateLimit
+	msgs   map[int32]*tokenBucket // only accessed in readLoop
+}
+
+func newConnLimiter(s *Server, addr net.Addr) *connLimiter {
+	opts := s.opts
+	if opts.connLimit == nil && s.ipLimiters == nil && len(opts.msgLimits) == 0 {
+		return nil
+	}
+	l := &connLimiter{
+		limits: opts.msgLimits,
+		msgs:   make(map[int32]*tokenBucket),
+	}
+	if opts.connLimit != nil {
+		l.conn = newTokenBucket(*opts.connLimit)
+	}
+	if s.ipLimiters != nil {
+		l.ips = s.ipLimiters
+		l.ip = remoteIP(addr)
+		l.ipb = l.ips.acquire(l.ip)
+	}
+	return l
+}
+
+// take takes a token for message msgType from every bucket, it returns
+// ErrRateLimited if some limit is exceeded, along with how long to wait before
+// processing the message if reserve is true, or 0 if it must not be processed.
+// The tokens already taken are given back when a later bucket denies, so a
+// message not processed costs nothing.
+func (l *connLimiter) take(msgType int32, reserve bool) (time.Duration, error) {
+	var msgBucket *tokenBucket
+	if limit, ok := l.limits[msgType]; ok {
+		tb, ok := l.msgs[msgType]
+		if !ok {
+			tb = newTokenBucket(limit)
+			l.msgs[msgType] = tb
+		}
+		msgBucket = tb
+	}
+
+	buckets := [...]struct {
+		tb    *tokenBucket
+		scope RateLimitScope
+	}{
+		{msgBucket, RateLimitMessage},
+		{l.conn, RateLimitConn},
+		{l.ipb, RateLimitIP},
+	}
+	var (
+		delay time.Duration
+		scope RateLimitScope
+	)
+	for i, b := range buckets {
+		if b.tb == nil {
+			continue
+		}
+		wait, ok := b.tb.take(reserve)
+		if !ok {
+			for _, taken := range buckets[:i] {
+				if taken.tb != nil {
+					taken.tb.refund()
+				}
+			}
+			return 0, ErrRateLimited{Scope: b.scope, MessageNumber: msgType}
+		}
+		if wait > delay {
+			delay, scope = wait, b.scope
+		}
+	}
+	if delay > 0 {
+		return delay, ErrRateLimited{Scope: scope, MessageNumber: msgType, Delay: delay}
+	}
+	return 0, nil
+}
+
+func (l *connLimiter) release() {
+	if l.ips != nil {
+		l.ips.release(l.ip)
+	}
+}
+
+// remoteIP returns the IP part of addr.
+func remoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
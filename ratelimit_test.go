@@ -0,0 +1,146 @@
+package tao
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurst(t *testing.T) {
+	tb := newTokenBucket(rateLimit{rate: 0, burst: 3})
+	for i := 0; i < 3; i++ {
+		if _, ok := tb.take(false); !ok {
+			t.Fatalf("take %d denied within burst", i)
+		}
+	}
+	if _, ok := tb.take(false); ok {
+		t.Fatal("take allowed beyond burst")
+	}
+	if _, ok := tb.take(true); ok {
+		t.Fatal("reserve allowed on bucket never refilled")
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	tb := newTokenBucket(rateLimit{rate: 10, burst: 1})
+	if wait, ok := tb.take(true); !ok || wait != 0 {
+		t.Fatalf("first take got (%v, %t), want (0, true)", wait, ok)
+	}
+	wait, ok := tb.take(true)
+	if !ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("reserved take got (%v, %t), want a wait up to 100ms", wait, ok)
+	}
+}
+
+func TestConnLimiterRefundsOnDeny(t *testing.T) {
+	l := &connLimiter{
+		limits: map[int32]rateLimit{1: {rate: 0, burst: 5}},
+		msgs:   make(map[int32]*tokenBucket),
+		conn:   newTokenBucket(rateLimit{rate: 0, burst: 1}),
+	}
+	if _, err := l.take(1, false); err != nil {
+		t.Fatalf("first message denied: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		_, err := l.take(1, false)
+		e, ok := err.(ErrRateLimited)
+		if !ok || e.Scope != RateLimitConn {
+			t.Fatalf("got %v, want connection rate limited", err)
+		}
+	}
+	// only the message processed is charged to the message bucket
+	if tokens := l.msgs[1].tokens; tokens != 4 {
+		t.Fatalf("message bucket has %v tokens, want 4", tokens)
+	}
+}
+
+func TestConnLimiterDelayReported(t *testing.T) {
+	l := &connLimiter{
+		msgs: make(map[int32]*tokenBucket),
+		conn: newTokenBucket(rateLimit{rate: 100, burst: 1}),
+	}
+	if delay, err := l.take(1, true); delay != 0 || err != nil {
+		t.Fatalf("message within burst got (%v, %v)", delay, err)
+	}
+	delay, err := l.take(1, true)
+	if delay <= 0 {
+		t.Fatal("no delay after burst exhausted")
+	}
+	e, ok := err.(ErrRateLimited)
+	if !ok || e.Scope != RateLimitConn || e.Delay != delay {
+		t.Fatalf("delayed message reported as %v, want connection rate limited", err)
+	}
+}
+
+// rateLimitErrors returns a ServerOption reporting rate limit errors to the
+// channel returned.
+func rateLimitErrors() (ServerOption, <-chan ErrRateLimited) {
+	errs := make(chan ErrRateLimited, 10)
+	return OnConnErrorOption(func(_ WriteCloser, err *ConnError) {
+		if e, ok := err.Err.(ErrRateLimited); ok && err.Kind == ErrorRateLimited {
+			errs <- e
+		}
+	}), errs
+}
+
+func TestRateLimitChargesEveryFrame(t *testing.T) {
+	onError, errs := rateLimitErrors()
+	_, addr := startServer(t, ConnRateLimitOption(0, 2), onError)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	writeFrame(t, conn, VersionMessage{Version: 1})
+	for i := 0; i < 2; i++ {
+		writeFrame(t, conn, HeartBeatMessage{Timestamp: int64(i)})
+	}
+	select {
+	case e := <-errs:
+		if e.MessageNumber != HeartBeat || e.Delay != 0 {
+			t.Fatalf("got %v, want heart beat dropped", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("heart beats not charged")
+	}
+}
+
+func TestRateLimitDelayReported(t *testing.T) {
+	handled := make(chan string, 2)
+	r := NewRouter()
+	Handle(r, textMessageNumber, func(_ context.Context, m *textMessage, _ WriteCloser) error {
+		handled <- m.Text
+		return nil
+	})
+	onError, errs := rateLimitErrors()
+	_, addr := startServer(t, RouterOption(r), onError,
+		ConnRateLimitOption(20, 1), RateLimitPolicyOption(RateLimitDelay))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	writeFrame(t, conn, &textMessage{Text: "first"})
+	writeFrame(t, conn, &textMessage{Text: "second"})
+	select {
+	case e := <-errs:
+		if e.Delay <= 0 {
+			t.Fatalf("got %v, want the message delayed", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("delayed message not reported")
+	}
+	for _, want := range []string{"first", "second"} {
+		select {
+		case text := <-handled:
+			if text != want {
+				t.Fatalf("handled %q, want %q", text, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s message not handled", want)
+		}
+	}
+}
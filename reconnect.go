@@ -0,0 +1,178 @@
+package tao
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// ReconnectState is the state of a reconnectable ClientConn.
+type ReconnectState int
+
+// States reported to the callback set by OnReconnectOption.
+const (
+	// StateDisconnected means the connection has been lost.
+	StateDisconnected ReconnectState = iota
+	// StateReconnecting means a new attempt of dialing is going on.
+	StateReconnecting
+	// StateReconnected means the connection has been re-established.
+	StateReconnected
+	// StateGaveUp means no more attempts will be made.
+	StateGaveUp
+)
+
+func (s ReconnectState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateReconnected:
+		return "reconnected"
+	case StateGaveUp:
+		return "gave up"
+	}
+	return "unknown"
+}
+
+// Backoff configures the delays between reconnect attempts. The n-th delay is
+// Initial*Multiplier^n capped at Max, randomized by +/- Jitter of itself.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+	// MaxAttempts is the number of attempts before giving up, 0 means unlimited.
+	MaxAttempts int
+}
+
+// DefaultBackoff is the Backoff used when none is provided.
+var DefaultBackoff = Backoff{
+	Initial:    100 * time.Millisecond,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// Delay returns the delay before the attempt-th (0-based) attempt.
+func (b Backoff) Delay(attempt int) time.Duration {
+	mult := b.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+	d := float64(b.Initial) * math.Pow(mult, float64(attempt))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// ReconnectBackoffOption returns a ServerOption that sets the backoff between
+// reconnect attempts of ClientConn.
+func ReconnectBackoffOption(b Backoff) ServerOption {
+	return func(o *options) {
+		o.backoff = &b
+	}
+}
+
+// ReconnectContextOption returns a ServerOption that sets the context of
+// reconnecting, ClientConn gives up reconnecting once ctx is done.
+func ReconnectContextOption(ctx context.Context) ServerOption {
+	return func(o *options) {
+		o.reconnectCtx = ctx
+	}
+}
+
+// OnReconnectOption returns a ServerOption that will set callback to call when
+// the reconnect state of ClientConn changes.
+func OnReconnectOption(cb func(WriteCloser, ReconnectState)) ServerOption {
+	return func(o *options) {
+		o.onReconnect = cb
+	}
+}
+
+// HandshakeOption returns a ServerOption that will set hook to call on the
+// newly-dialed connection before ClientConn starts, the connection is dropped
+// if it returns an error.
+func HandshakeOption(cb func(net.Conn) error) ServerOption {
+	return func(o *options) {
+		o.handshake = cb
+	}
+}
+
+// ResubscribeOption returns a ServerOption that will set callback to call after
+// ClientConn reconnected, for restoring session state on server.
+func ResubscribeOption(cb func(WriteCloser)) ServerOption {
+	return func(o *options) {
+		o.resubscribe = cb
+	}
+}
+
+// reconnect dials until succeeded or gave up, and then replaces the session
+// of cc with the newly-dialed connection. It runs in its own go-routine and
+// stops as soon as cc is closed by user.
+func (cc *ClientConn) reconnect() {
+	opts := cc.opts
+	notify := func(state ReconnectState) {
+		if state == StateGaveUp && opts.outbox != nil {
+			opts.outbox.close()
+		}
+		if opts.onReconnect != nil {
+			opts.onReconnect(cc, state)
+		}
+	}
+
+	ctx := cc.reconnectCtx
+	backoff := DefaultBackoff
+	if opts.backoff != nil {
+		backoff = *opts.backoff
+	}
+
+	notify(StateDisconnected)
+	for attempt := 0; backoff.MaxAttempts <= 0 || attempt < backoff.MaxAttempts; attempt++ {
+		select {
+		case <-time.After(backoff.Delay(attempt)):
+		case <-ctx.Done():
+			notify(StateGaveUp)
+			return
+		}
+
+		notify(StateReconnecting)
+		c, err := dialConn(ctx, cc.network, cc.addr, opts)
+		if err != nil {
+			if cc.logger != nil {
+				cc.logger.Errorf("reconnect %s attempt %d error %v\n", cc.addr, attempt+1, err)
+			}
+			continue
+		}
+
+		s := newClientSession(c, opts)
+		cc.mu.Lock()
+		if cc.closed {
+			cc.mu.Unlock()
+			s.cancel()
+			s.timing.Stop()
+			c.Close()
+			notify(StateGaveUp)
+			return
+		}
+		cc.sess = s
+		cc.mu.Unlock()
+
+		cc.start(s)
+		notify(StateReconnected)
+		if opts.resubscribe != nil {
+			opts.resubscribe(cc)
+		}
+		return
+	}
+	notify(StateGaveUp)
+}
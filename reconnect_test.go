@@ -0,0 +1,148 @@
+package tao
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, w := range want {
+		if d := b.Delay(i); d != w {
+			t.Errorf("delay of attempt %d is %v, want %v", i, d, w)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Multiplier: 1, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if d := b.Delay(i); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("delay %v out of 100ms +/- 50%%", d)
+		}
+	}
+}
+
+// pipeDialer returns a dialer of net.Pipe, sending the server end of every
+// connection dialed to peers, which is drained until closed.
+func pipeDialer(peers chan<- net.Conn) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go io.Copy(io.Discard, server)
+		peers <- server
+		return client, nil
+	}
+}
+
+func TestReconnectReplacesSession(t *testing.T) {
+	peers := make(chan net.Conn, 2)
+	states := make(chan ReconnectState, 8)
+	dial := pipeDialer(peers)
+	c, _ := dial(context.Background(), "pipe", "pipe")
+	cc := NewClientConn(1, c,
+		ReconnectOption(),
+		DialerOption(dial),
+		ReconnectBackoffOption(Backoff{Initial: time.Millisecond}),
+		OnReconnectOption(func(_ WriteCloser, s ReconnectState) { states <- s }),
+	)
+	defer cc.Close()
+	cc.Start()
+
+	first := cc.session()
+	(<-peers).Close()
+	for s := range states {
+		if s == StateGaveUp {
+			t.Fatal("gave up reconnecting")
+		}
+		if s == StateReconnected {
+			break
+		}
+	}
+	if cc.session() == first {
+		t.Fatal("session not replaced after reconnected")
+	}
+	if cc.isClosed() {
+		t.Fatal("reconnected connection is closed")
+	}
+	if err := cc.Write(HeartBeatMessage{Timestamp: 1}); err != nil {
+		t.Fatalf("write after reconnected: %v", err)
+	}
+}
+
+func TestCloseStopsReconnecting(t *testing.T) {
+	var dials int32
+	states := make(chan ReconnectState, 64)
+	client, server := net.Pipe()
+	go io.Copy(io.Discard, server)
+	cc := NewClientConn(1, client,
+		ReconnectOption(),
+		DialerOption(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return nil, errors.New("refused")
+		}),
+		ReconnectBackoffOption(Backoff{Initial: time.Millisecond}),
+		OnReconnectOption(func(_ WriteCloser, s ReconnectState) { states <- s }),
+	)
+	cc.Start()
+
+	server.Close()
+	// the second attempt begins after the first one failed
+	for attempts := 0; attempts < 2; {
+		if s := <-states; s == StateReconnecting {
+			attempts++
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cc.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked by reconnecting")
+	}
+	for s := range states {
+		if s == StateGaveUp {
+			break
+		}
+	}
+	if atomic.LoadInt32(&dials) == 0 {
+		t.Fatal("never dialed before Close")
+	}
+}
+
+func TestCloseByUserNotReconnect(t *testing.T) {
+	var dials int32
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+	cc := NewClientConn(1, client,
+		ReconnectOption(),
+		DialerOption(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return nil, errors.New("refused")
+		}),
+		ReconnectBackoffOption(Backoff{Initial: time.Millisecond}),
+	)
+	cc.Start()
+	cc.Close()
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&dials); n != 0 {
+		t.Fatalf("dialed %d times after closed by user", n)
+	}
+}
@@ -0,0 +1,224 @@
+package tao
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Router maps message numbers to unmarshal and handle functions. Package
+// level Register and Handle with DefaultRouter register on DefaultRouter, which
+// is used unless RouterOption is passed.
+type Router struct {
+	mu      sync.RWMutex // guards following
+	entries map[int32]handlerUnmarshaler
+}
+
+// DefaultRouter is the router used by servers and clients without RouterOption.
+var DefaultRouter = NewRouter()
+
+// NewRouter returns a new empty router.
+func NewRouter() *Router {
+	return &Router{
+		entries: make(map[int32]handlerUnmarshaler),
+	}
+}
+
+// RouterOption returns a ServerOption that makes server or client connection
+// look up unmarshal and handle functions in r instead of DefaultRouter.
+func RouterOption(r *Router) ServerOption {
+	return func(o *options) {
+		o.router = r
+	}
+}
+
+// Register registers the unmarshal and handle functions for msgType on r, see
+// the package level Register.
+func (r *Router) Register(msgType int32, unmarshaler func([]byte) (Message, error), handler func(context.Context, WriteCloser), opts ...RegisterOption) {
+	entry := handlerUnmarshaler{
+		unmarshaler: unmarshaler,
+	}
+	if handler != nil {
+		entry.handler = func(ctx context.Context, c WriteCloser) error {
+			handler(ctx, c)
+			return nil
+		}
+	}
+	r.register(msgType, entry, opts)
+}
+
+// RegisterFunc registers the unmarshal function and the error returning
+// handler for msgType on r, see the package level RegisterFunc.
+func (r *Router) RegisterFunc(msgType int32, unmarshaler func([]byte) (Message, error), handler func(context.Context, WriteCloser) error, opts ...RegisterOption) {
+	r.register(msgType, handlerUnmarshaler{
+		unmarshaler: unmarshaler,
+		handler:     handler,
+	}, opts)
+}
+
+func (r *Router) register(msgType int32, entry handlerUnmarshaler, opts []RegisterOption) {
+	for _, o := range opts {
+		o(&entry)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[msgType]; ok {
+		panic(fmt.Sprintf("trying to register message %d twice", msgType))
+	}
+	r.entries[msgType] = entry
+}
+
+func (r *Router) lookup(msgType int32) (handlerUnmarshaler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.entries[msgType]
+	return entry, ok
+}
+
+// UnmarshalFunc returns the corresponding unmarshal function for msgType.
+func (r *Router) UnmarshalFunc(msgType int32) UnmarshalFunc {
+	entry, _ := r.lookup(msgType)
+	return entry.unmarshaler
+}
+
+// HandlerFunc returns the corresponding handler function for msgType, errors
+// returned by handlers registered by RegisterFunc or Handle are reported and
+// sent back to peer as it is called.
+func (r *Router) HandlerFunc(msgType int32) HandlerFunc {
+	handler := r.handleFunc(msgType)
+	if handler == nil {
+		return nil
+	}
+	return func(ctx context.Context, c WriteCloser) {
+		if err := handler(ctx, c); err != nil {
+			replyError(c, MessageFromContext(ctx), err)
+		}
+	}
+}
+
+// handleFunc returns the error returning handler function for msgType.
+func (r *Router) handleFunc(msgType int32) handleFunc {
+	entry, _ := r.lookup(msgType)
+	return entry.handler
+}
+
+// ACL returns the access control list declared for msgType, nil if any
+// principal is allowed.
+func (r *Router) ACL(msgType int32) *ACL {
+	entry, _ := r.lookup(msgType)
+	return entry.acl
+}
+
+// Priority returns the priority declared for msgType, heart beats are of
+// PriorityHigh unless declared otherwise.
+func (r *Router) Priority(msgType int32) Priority {
+	entry, ok := r.lookup(msgType)
+	if !ok {
+		if msgType == HeartBeat {
+			return PriorityHigh
+		}
+		return PriorityNormal
+	}
+	return entry.priority
+}
+
+// routerOf returns r, or DefaultRouter if r is nil.
+func routerOf(r *Router) *Router {
+	if r == nil {
+		return DefaultRouter
+	}
+	return r
+}
+
+// binaryUnmarshaler is implemented by messages generated by protobuf and
+// alike, which are unmarshaled in place.
+type binaryUnmarshaler interface {
+	Unmarshal([]byte) error
+}
+
+// Handle registers a typed handler for message num on r, the unmarshal
+// function is inferred from T, which must be a pointer type implementing
+// encoding.BinaryUnmarshaler or Unmarshal([]byte) error, or a type whose
+// pointer does. It panics if T can not be unmarshaled, or its MessageNumber is
+// not num. Errors returned by handler are reported to OnConnErrorOption and sent
+// back to peer as ErrorMessage.
+func Handle[T Message](r *Router, num int32, handler func(context.Context, T, WriteCloser) error, opts ...RegisterOption) {
+	unmarshaler, err := unmarshalerOf[T]()
+	if err != nil {
+		panic(fmt.Sprintf("trying to handle message %d: %v", num, err))
+	}
+	if n := newMessage[T]().MessageNumber(); n != num {
+		panic(fmt.Sprintf("trying to handle message %d with %s of message number %d",
+			num, reflect.TypeOf((*T)(nil)).Elem(), n))
+	}
+
+	entry := handlerUnmarshaler{
+		unmarshaler: unmarshaler,
+	}
+	if handler != nil {
+		entry.handler = func(ctx context.Context, c WriteCloser) error {
+			msg, ok := MessageFromContext(ctx).(T)
+			if !ok {
+				// decoded by a codec not using r
+				return fmt.Errorf("message %d of type %T, expecting %s",
+					num, MessageFromContext(ctx), reflect.TypeOf((*T)(nil)).Elem())
+			}
+			return handler(ctx, msg, c)
+		}
+	}
+	routerOf(r).register(num, entry, opts)
+}
+
+// newMessage returns a new zero message of type T, allocating the value
+// pointed to if T is a pointer.
+func newMessage[T Message]() T {
+	var msg T
+	if t := reflect.TypeOf((*T)(nil)).Elem(); t.Kind() == reflect.Ptr {
+		msg = reflect.New(t.Elem()).Interface().(T)
+	}
+	return msg
+}
+
+// unmarshalerOf returns the unmarshal function of message type T.
+func unmarshalerOf[T Message]() (UnmarshalFunc, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() == reflect.Ptr {
+		if !canUnmarshal(newMessage[T]()) {
+			return nil, fmt.Errorf("%s implements neither encoding.BinaryUnmarshaler nor Unmarshal([]byte) error", t)
+		}
+		return func(data []byte) (Message, error) {
+			msg := newMessage[T]()
+			return msg, unmarshalInto(msg, data)
+		}, nil
+	}
+
+	if !canUnmarshal(new(T)) {
+		return nil, fmt.Errorf("*%s implements neither encoding.BinaryUnmarshaler nor Unmarshal([]byte) error", t)
+	}
+	return func(data []byte) (Message, error) {
+		msg := new(T)
+		err := unmarshalInto(msg, data)
+		return *msg, err
+	}, nil
+}
+
+func canUnmarshal(v interface{}) bool {
+	switch v.(type) {
+	case encoding.BinaryUnmarshaler, binaryUnmarshaler:
+		return true
+	}
+	return false
+}
+
+func unmarshalInto(v interface{}, data []byte) error {
+	switch u := v.(type) {
+	case encoding.BinaryUnmarshaler:
+		return u.UnmarshalBinary(data)
+	case binaryUnmarshaler:
+		return u.Unmarshal(data)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package tao
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	textMessageNumber   = 10
+	numberMessageNumber = 11
+)
+
+// textMessage is unmarshaled in place by its pointer.
+type textMessage struct {
+	Text string
+}
+
+func (m *textMessage) MessageNumber() int32 { return textMessageNumber }
+
+func (m *textMessage) Serialize() ([]byte, error) { return []byte(m.Text), nil }
+
+func (m *textMessage) UnmarshalBinary(data []byte) error {
+	m.Text = string(data)
+	return nil
+}
+
+// numberMessage is a value message whose pointer unmarshals.
+type numberMessage int32
+
+var errNumberSize = errors.New("number message of 4 bytes")
+
+func numberBytes(n uint32) []byte {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, n)
+	return data
+}
+
+func (m numberMessage) MessageNumber() int32 { return numberMessageNumber }
+
+func (m numberMessage) Serialize() ([]byte, error) {
+	return numberBytes(uint32(m)), nil
+}
+
+func (m *numberMessage) Unmarshal(data []byte) error {
+	if len(data) != 4 {
+		return errNumberSize
+	}
+	*m = numberMessage(binary.LittleEndian.Uint32(data))
+	return nil
+}
+
+// mustPanic fails t unless f panics.
+func mustPanic(t *testing.T, name string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s did not panic", name)
+		}
+	}()
+	f()
+}
+
+func TestRouterRegister(t *testing.T) {
+	r := NewRouter()
+	called := false
+	r.Register(1, DeserializeHeartBeat, func(context.Context, WriteCloser) { called = true },
+		PriorityOption(PriorityLow), RolesOption("admin"))
+	r.Register(2, nil, nil)
+
+	if r.UnmarshalFunc(1) == nil || r.HandlerFunc(1) == nil {
+		t.Fatal("functions registered not found")
+	}
+	if r.HandlerFunc(1)(context.Background(), nil); !called {
+		t.Fatal("handler registered not called")
+	}
+	if r.UnmarshalFunc(2) != nil || r.HandlerFunc(2) != nil {
+		t.Fatal("nil functions registered found")
+	}
+	if r.UnmarshalFunc(3) != nil || r.HandlerFunc(3) != nil || r.ACL(3) != nil {
+		t.Fatal("message not registered found")
+	}
+	if acl := r.ACL(1); acl == nil || len(acl.Roles) != 1 || acl.Roles[0] != "admin" {
+		t.Fatalf("acl %+v, want roles [admin]", acl)
+	}
+
+	for _, tc := range []struct {
+		msgType int32
+		want    Priority
+	}{
+		{1, PriorityLow},
+		{2, PriorityNormal},
+		{3, PriorityNormal},
+		{HeartBeat, PriorityHigh},
+	} {
+		if got := r.Priority(tc.msgType); got != tc.want {
+			t.Errorf("priority of message %d is %s, want %s", tc.msgType, got, tc.want)
+		}
+	}
+
+	mustPanic(t, "registering twice", func() { r.Register(2, nil, nil) })
+	if DefaultRouter.UnmarshalFunc(1) != nil {
+		t.Fatal("registered on DefaultRouter")
+	}
+}
+
+func TestHandle(t *testing.T) {
+	r := NewRouter()
+	errHandler := errors.New("handler failed")
+	var got []Message
+	Handle(r, textMessageNumber, func(_ context.Context, m *textMessage, _ WriteCloser) error {
+		got = append(got, m)
+		return errHandler
+	})
+	Handle(r, numberMessageNumber, func(_ context.Context, m numberMessage, _ WriteCloser) error {
+		got = append(got, m)
+		return nil
+	})
+
+	text, err := r.UnmarshalFunc(textMessageNumber)([]byte("hello"))
+	if m, ok := text.(*textMessage); err != nil || !ok || m.Text != "hello" {
+		t.Fatalf("unmarshaled (%#v, %v), want *textMessage hello", text, err)
+	}
+	number, err := r.UnmarshalFunc(numberMessageNumber)(numberBytes(42))
+	if m, ok := number.(numberMessage); err != nil || !ok || m != 42 {
+		t.Fatalf("unmarshaled (%#v, %v), want numberMessage 42", number, err)
+	}
+	if _, err := r.UnmarshalFunc(numberMessageNumber)([]byte{1}); err != errNumberSize {
+		t.Fatalf("unmarshal bad data got %v, want its error", err)
+	}
+
+	ctx := context.Background()
+	if err := r.handleFunc(textMessageNumber)(NewContextWithMessage(ctx, text), nil); err != errHandler {
+		t.Fatalf("handler got %v, want its error", err)
+	}
+	if err := r.handleFunc(numberMessageNumber)(NewContextWithMessage(ctx, number), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != text || got[1] != number {
+		t.Fatalf("handled %v, want the messages unmarshaled", got)
+	}
+	// decoded by a codec not using r
+	if err := r.handleFunc(textMessageNumber)(NewContextWithMessage(ctx, number), nil); err == nil {
+		t.Fatal("handler of message of other type got no error")
+	}
+}
+
+func TestHandlePanics(t *testing.T) {
+	r := NewRouter()
+	mustPanic(t, "handling message not unmarshalable", func() {
+		Handle(r, 1, func(context.Context, outboxMessage, WriteCloser) error { return nil })
+	})
+	mustPanic(t, "handling message of other number", func() {
+		Handle(r, numberMessageNumber, func(context.Context, *textMessage, WriteCloser) error { return nil })
+	})
+	if r.UnmarshalFunc(1) != nil || r.UnmarshalFunc(numberMessageNumber) != nil {
+		t.Fatal("registered after panicked")
+	}
+}
+
+func TestRouterOption(t *testing.T) {
+	r := NewRouter()
+	received := make(chan string, 1)
+	Handle(r, textMessageNumber, func(_ context.Context, m *textMessage, _ WriteCloser) error {
+		received <- m.Text
+		return nil
+	})
+	_, addr := startServer(t, RouterOption(r))
+	cc, err := Dial(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Start()
+	defer cc.Close()
+
+	if err := cc.Write(&textMessage{Text: "routed"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case text := <-received:
+		if text != "routed" {
+			t.Fatalf("received %q, want routed", text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not routed by RouterOption")
+	}
+}
@@ -22,11 +22,46 @@ var (
 type options struct {
 	tlsCfg    *tls.Config
 	codec     Codec
+	router    *Router
+	version   uint32
 	onConnect onConnectFunc
 	onMessage onMessageFunc
 	onClose   onCloseFunc
 	onError   onErrorFunc
-	reconnect bool // for ClientConn use only
+	onDenied  onDeniedFunc
+	// reconnecting, for ClientConn use only
+	reconnect    bool
+	backoff      *Backoff
+	reconnectCtx context.Context
+	onReconnect  func(WriteCloser, ReconnectState)
+	handshake    func(net.Conn) error
+	resubscribe  func(WriteCloser)
+	outboxSize   int
+	outboxTTL    time.Duration
+	onExpire     func(Message)
+	outbox       *outbox
+	dialTimeout  time.Duration
+	localAddr    net.Addr
+	keepAlive    time.Duration
+	serverName   string
+	dialer       func(context.Context, string, string) (net.Conn, error)
+	// heart beats
+	heartInterval time.Duration
+	heartTimeout  time.Duration
+	// deadlines
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	handshakeTimeout time.Duration
+	// inbound rate limits, for Server use only
+	connLimit       *rateLimit
+	ipLimit         *rateLimit
+	msgLimits       map[int32]rateLimit
+	rateLimitPolicy RateLimitPolicy
+	panicPolicy     PanicPolicy
+	scheduling      Scheduling
+	admission       admissionRules // for Server use only
+	proxyProtocol   bool           // for Server use only
+	config          *ServerConfig
 }
 
 // ServerOption sets server options.
@@ -79,23 +114,49 @@ func OnCloseOption(cb func(WriteCloser)) ServerOption {
 }
 
 // OnErrorOption returns a ServerOption that will set callback to call when error
-// occurs.
+// occurs. It is kept for compatibility, see OnConnErrorOption for the error.
 func OnErrorOption(cb func(WriteCloser)) ServerOption {
+	return OnConnErrorOption(func(c WriteCloser, _ *ConnError) { cb(c) })
+}
+
+// OnConnErrorOption returns a ServerOption that will set callback to call when
+// error occurs, the ConnError tells what kind of error it is and which message.
+// The callback runs asynchronously, after the error occurred, on a worker
+// go-routine rather than the connection's own, so it may call Close on the
+// connection. Errors of a connection are reported in order, along with its
+// messages handled, unless the workers are saturated.
+func OnConnErrorOption(cb func(WriteCloser, *ConnError)) ServerOption {
 	return func(o *options) {
 		o.onError = cb
 	}
 }
 
+// ACLDeniedOption returns a ServerOption that will set callback to call when a
+// message is denied by its ACL, the returned message, if not nil, is sent back
+// to the peer as an error frame.
+func ACLDeniedOption(cb func(Message, *Principal) Message) ServerOption {
+	return func(o *options) {
+		o.onDenied = cb
+	}
+}
+
 // Server  is a server to serve TCP requests.
 type Server struct {
-	opts   options
-	ctx    context.Context
-	cancel context.CancelFunc
-	conns  *ConnMap
-	timing *TimingWheel
-	wg     *sync.WaitGroup
-	mu     sync.Mutex // guards following
-	lis    map[net.Listener]bool
+	opts       options
+	ctx        context.Context
+	cancel     context.CancelFunc
+	conns      *ConnMap
+	timing     *TimingWheel
+	ipLimiters *ipLimiters
+	admission  *admission
+	workers    *WorkerPool
+	pubsub     *pubsub
+	groups     *groupRegistry
+	attrIndex  *attrIndex
+	wg         *sync.WaitGroup
+	mu         sync.Mutex // guards following
+	config     ServerConfig
+	lis        map[net.Listener]bool
 	// for periodically running function every duration.
 	interv time.Duration
 	sched  onScheduleFunc
@@ -103,25 +164,39 @@ type Server struct {
 }
 
 // NewServer returns a new TCP server which has not started
-// to serve requests yet.
+// to serve requests yet. It panics if the ServerConfig applied is invalid.
 func NewServer(logger LoggerInterface, opt ...ServerOption) *Server {
 	var opts options
 	for _, o := range opt {
 		o(&opts)
 	}
 	if opts.codec == nil {
-		opts.codec = TypeLengthValueCodec{}
+		opts.codec = TypeLengthValueCodec{Router: opts.router}
+	}
+
+	cfg := resolveConfig(opts)
+	if err := cfg.Validate(); err != nil {
+		panic(err.Error())
 	}
 
 	s := &Server{
-		opts:   opts,
-		conns:  NewConnMap(),
-		wg:     &sync.WaitGroup{},
-		lis:    make(map[net.Listener]bool),
-		logger: logger,
+		opts:      opts,
+		conns:     NewConnMap(),
+		wg:        &sync.WaitGroup{},
+		config:    cfg,
+		lis:       make(map[net.Listener]bool),
+		admission: newAdmission(opts.admission, cfg.MaxConnections, cfg.MaxConnsPerIP),
+		workers:   newWorkerPool(cfg.WorkersNum, cfg.MaxWorkers, logger),
+		pubsub:    newPubSub(),
+		groups:    newGroupRegistry(),
+		attrIndex: newAttrIndex(),
+		logger:    logger,
+	}
+	if opts.ipLimit != nil {
+		s.ipLimiters = newIPLimiters(*opts.ipLimit)
 	}
 	s.ctx, s.cancel = context.WithCancel(context.Background())
-	s.timing = NewTimingWheel(s.ctx)
+	s.timing = newTimingWheel(s.ctx, cfg.TimingWheelQueueSize)
 	return s
 }
 
@@ -138,25 +213,19 @@ func (s *Server) Sched(dur time.Duration, sched func(time.Time, WriteCloser)) {
 	s.sched = onScheduleFunc(sched)
 }
 
-// Broadcast broadcasts message to all server connections managed.
+// Broadcast broadcasts message to all server connections managed, the message
+// is encoded once.
 func (s *Server) Broadcast(msg Message) {
-	s.conns.RLock()
-	defer s.conns.RUnlock()
-	for idx, c := range s.conns.m {
-		s.logger.Tracef("bro %v %v", idx, msg)
-		if err := c.Write(msg); err != nil {
-			if s.logger != nil {
-				s.logger.Errorf("broadcast error %v\n", err)
-			}
+	if err := s.BroadcastFunc(msg, nil); err != nil {
+		if s.logger != nil {
+			s.logger.Errorf("broadcast error %v\n", err)
 		}
 	}
 }
 
 // Unicast unicasts message to a specified conn.
 func (s *Server) Unicast(id int64, msg Message) error {
-	s.conns.RLock()
-	defer s.conns.RUnlock()
-	c, ok := s.conns.m[id]
+	c, ok := s.conns.Get(id)
 	if ok {
 		return c.Write(msg)
 	}
@@ -165,10 +234,7 @@ func (s *Server) Unicast(id int64, msg Message) error {
 
 // GetConn returns a server connection with specified ID.
 func (s *Server) GetConn(id int64) (*ServerConn, bool) {
-	s.conns.RLock()
-	defer s.conns.RUnlock()
-	sc, ok := s.conns.m[id]
-	return sc, ok
+	return s.conns.Get(id)
 }
 
 // Start starts the TCP server, accepting new clients and creating service
@@ -226,38 +292,70 @@ func (s *Server) Start(l net.Listener) error {
 		}
 		tempDelay = 0
 
-		// how many connections do we have ?
-		sz := s.conns.Size()
-		if sz >= MaxConnections {
-			if s.logger != nil {
-				s.logger.Warnf("max connections size %d, refuse\n", sz)
-			}
-			rawConn.Close()
+		if s.opts.proxyProtocol {
+			// reading PROXY protocol header may block, don't hold the accept loop.
+			s.wg.Add(1)
+			go func(c net.Conn) {
+				defer s.wg.Done()
+				timeout := proxyHeaderTimeout
+				if s.opts.handshakeTimeout > 0 {
+					timeout = s.opts.handshakeTimeout
+				}
+				pc, err := readProxyHeader(c, timeout)
+				if err != nil {
+					if s.logger != nil {
+						s.logger.Warnf("refuse %v, PROXY protocol error %v\n", c.RemoteAddr(), err)
+					}
+					addTotalRejected()
+					c.Close()
+					return
+				}
+				s.serve(pc)
+			}(rawConn)
 			continue
 		}
+		s.serve(rawConn)
+	} // for loop
+}
+
+// serve admits the accepted connection and starts a ServerConn for it.
+func (s *Server) serve(rawConn net.Conn) {
+	if s.ctx.Err() != nil {
+		rawConn.Close()
+		return
+	}
 
-		if s.opts.tlsCfg != nil {
-			rawConn = tls.Server(rawConn, s.opts.tlsCfg)
+	// evaluate admission rules before allocating anything for it.
+	if err := s.admission.admit(rawConn); err != nil {
+		if s.logger != nil {
+			s.logger.Warnf("refuse %v, %v\n", rawConn.RemoteAddr(), err)
 		}
+		addTotalRejected()
+		rawConn.Close()
+		return
+	}
 
-		netid := netIdentifier.GetAndIncrement()
-		sc := NewServerConn(netid, s, rawConn)
-		sc.SetName(sc.rawConn.RemoteAddr().String())
+	if s.opts.tlsCfg != nil {
+		rawConn = tls.Server(rawConn, s.opts.tlsCfg)
+	}
 
-		s.mu.Lock()
-		if s.sched != nil {
-			sc.RunEvery(s.interv, s.sched)
-		}
-		s.mu.Unlock()
+	netid := netIdentifier.GetAndIncrement()
+	sc := NewServerConn(netid, s, rawConn)
+	sc.SetName(sc.rawConn.RemoteAddr().String())
 
-		s.conns.Put(netid, sc)
-		addTotalConn(1)
+	s.mu.Lock()
+	if s.sched != nil {
+		sc.RunEvery(s.interv, s.sched)
+	}
+	s.mu.Unlock()
 
-		s.wg.Add(1)
-		go func() {
-			sc.Start()
-		}()
-	} // for loop
+	s.conns.Put(netid, sc)
+	addTotalConn(1)
+
+	s.wg.Add(1)
+	go func() {
+		sc.Start()
+	}()
 }
 
 // Stop gracefully closes the server, it blocked until all connections
@@ -277,14 +375,7 @@ func (s *Server) Stop() {
 	}
 
 	// close all connections
-	s.conns.Lock()
-	conns := map[int64]*ServerConn{}
-	for k, v := range s.conns.m {
-		conns[k] = v
-	}
-	s.conns.Unlock()
-
-	for _, c := range conns {
+	for _, c := range s.conns.Snapshot() {
 		c.rawConn.Close()
 		if s.logger != nil {
 			s.logger.Infof("close client %s\n", c.GetName())
@@ -296,6 +387,7 @@ func (s *Server) Stop() {
 	s.mu.Unlock()
 
 	s.wg.Wait()
+	s.workers.Close()
 
 	if s.logger != nil {
 		s.logger.Infof("server stopped gracefully, bye.")
@@ -314,9 +406,19 @@ func (s *Server) timeOutLoop() {
 			return
 
 		case timeout := <-s.timing.GetTimeOutChannel():
+			if g, ok := timeout.Ctx.Value(groupCtx).(*Group); ok {
+				g.dispatch(timeout)
+				continue
+			}
 			netID := timeout.Ctx.Value(netIDCtx).(int64)
 			if sc, ok := s.conns.Get(netID); ok {
-				sc.timerCh <- timeout
+				select {
+				case sc.timerCh <- timeout:
+				default:
+					// handleLoop may be waiting for a worker, not to block
+					// timers of other connections.
+					reportError(sc, ErrorOverflow, noMessage, ErrWouldBlock)
+				}
 			} else {
 				if s.logger != nil {
 					s.logger.Warnf("invalid client %d\n", netID)
@@ -0,0 +1,46 @@
+package tao
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimerOverflow(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.TimerQueueSize = 1
+	overflowed := make(chan struct{}, 4)
+	s, addr := startServer(t, ConfigOption(cfg), OnConnErrorOption(func(_ WriteCloser, err *ConnError) {
+		if err.Kind == ErrorOverflow {
+			overflowed <- struct{}{}
+		}
+	}))
+
+	ids := connectClients(t, s, addr, 1)
+	sc, _ := s.GetConn(ids[0])
+
+	// not started, nobody takes its timers
+	client, server := net.Pipe()
+	defer client.Close()
+	stuck := NewServerConn(-1, s, server)
+	s.conns.Put(stuck.GetNetID(), stuck)
+	defer s.conns.Remove(stuck.GetNetID())
+	for i := 0; i < 3; i++ {
+		stuck.RunAfter(time.Millisecond, func(time.Time, WriteCloser) {})
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-overflowed:
+		case <-time.After(time.Second):
+			t.Fatal("timer overflowed not reported")
+		}
+	}
+
+	fired := make(chan struct{})
+	sc.RunAfter(time.Millisecond, func(time.Time, WriteCloser) { close(fired) })
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("timers of other connections blocked")
+	}
+}
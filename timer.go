@@ -94,13 +94,17 @@ type TimingWheel struct {
 
 // NewTimingWheel returns a *TimingWheel ready for use.
 func NewTimingWheel(ctx context.Context) *TimingWheel {
+	return newTimingWheel(ctx, DefaultQueueSize)
+}
+
+func newTimingWheel(ctx context.Context, size int) *TimingWheel {
 	timingWheel := &TimingWheel{
-		timeOutChan: make(chan *OnTimeOut, 1024),
+		timeOutChan: make(chan *OnTimeOut, size),
 		timers:      make(timerHeapType, 0),
 		ticker:      time.NewTicker(500 * time.Millisecond),
 		wg:          &sync.WaitGroup{},
-		addChan:     make(chan *timerType, 1024),
-		cancelChan:  make(chan int64, 1024),
+		addChan:     make(chan *timerType, size),
+		cancelChan:  make(chan int64, size),
 		sizeChan:    make(chan int),
 	}
 	timingWheel.ctx, timingWheel.cancel = context.WithCancel(ctx)
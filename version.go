@@ -0,0 +1,164 @@
+package tao
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+	"time"
+)
+
+// ProtocolVersionOption returns a ServerOption that enables version
+// negotiation. ClientConn sends its version as the first frame, and ServerConn
+// answers with the lower of both, which is then stored on the connections and
+// used to decode each incoming frame. Version 0 means no versioning, frames of
+// peers never negotiating are decoded by the current unmarshalers. Versions are
+// negotiated once, any other VersionMessage closes the connection with
+// ErrUnexpectedVersion reported as ErrorHandshake.
+func ProtocolVersionOption(version uint32) ServerOption {
+	return func(o *options) {
+		o.version = version
+	}
+}
+
+// VersionOption returns a RegisterOption that declares the unmarshal function
+// of frames from peers speaking protocol version or lower, down to the next
+// version declared. upconverter, if not nil, maps the message unmarshaled to
+// the current one handled. Peers above all the versions declared use the
+// unmarshal function registered.
+func VersionOption(version uint32, unmarshaler UnmarshalFunc, upconverter func(Message) (Message, error)) RegisterOption {
+	return func(h *handlerUnmarshaler) {
+		h.versions = append(h.versions, versionedUnmarshaler{
+			version:     version,
+			unmarshaler: unmarshaler,
+			upconverter: upconverter,
+		})
+		sort.Slice(h.versions, func(i, j int) bool {
+			return h.versions[i].version < h.versions[j].version
+		})
+	}
+}
+
+// versionedUnmarshaler unmarshals frames of an older version.
+type versionedUnmarshaler struct {
+	version     uint32
+	unmarshaler UnmarshalFunc
+	upconverter func(Message) (Message, error)
+}
+
+func (vu versionedUnmarshaler) unmarshal(data []byte) (Message, error) {
+	msg, err := vu.unmarshaler(data)
+	if err != nil || vu.upconverter == nil {
+		return msg, err
+	}
+	return vu.upconverter(msg)
+}
+
+// VersionUnmarshalFunc returns the unmarshal function for msgType sent by peer
+// speaking version, upconverting older messages to the current one.
+func (r *Router) VersionUnmarshalFunc(msgType int32, version uint32) UnmarshalFunc {
+	entry, ok := r.lookup(msgType)
+	if !ok {
+		return nil
+	}
+	if version != 0 {
+		i := sort.Search(len(entry.versions), func(i int) bool {
+			return entry.versions[i].version >= version
+		})
+		if i < len(entry.versions) {
+			return entry.versions[i].unmarshal
+		}
+	}
+	return entry.unmarshaler
+}
+
+// VersionedCodec is a Codec able to decode frames of the protocol version
+// negotiated on connection.
+type VersionedCodec interface {
+	Codec
+	DecodeVersion(net.Conn, uint32) (Message, error)
+}
+
+// VersionMessage negotiates the protocol version at connection start.
+type VersionMessage struct {
+	Version uint32
+}
+
+// Serialize serializes VersionMessage into bytes.
+func (vm VersionMessage) Serialize() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, vm.Version); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MessageNumber returns message number.
+func (vm VersionMessage) MessageNumber() int32 {
+	return VersionMessageNumber
+}
+
+// DeserializeVersionMessage deserializes bytes into Message.
+func DeserializeVersionMessage(data []byte) (Message, error) {
+	if data == nil {
+		return nil, ErrNilData
+	}
+	var vm VersionMessage
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &vm.Version); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// negotiateVersion returns the version both sides speak, 0 if neither
+// versions its messages.
+func negotiateVersion(local, peer uint32) uint32 {
+	if local == 0 || (peer != 0 && peer < local) {
+		return peer
+	}
+	return local
+}
+
+// Version returns the protocol version negotiated, 0 if none.
+func (sc *ServerConn) Version() uint32 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.version
+}
+
+func (sc *ServerConn) setVersion(version uint32) {
+	sc.mu.Lock()
+	sc.version = version
+	sc.mu.Unlock()
+}
+
+// Version returns the protocol version negotiated, 0 if none.
+func (cc *ClientConn) Version() uint32 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.sess.version
+}
+
+func (cc *ClientConn) setVersion(version uint32) {
+	cc.mu.Lock()
+	cc.sess.version = version
+	cc.mu.Unlock()
+}
+
+// sendVersion writes the version of client as the first frame, before any
+// other is queued to writeLoop.
+func (cc *ClientConn) sendVersion(s *clientSession) error {
+	if cc.opts.version == 0 {
+		return nil
+	}
+	data, err := cc.opts.codec.Encode(VersionMessage{Version: cc.opts.version})
+	if err != nil {
+		return err
+	}
+	if cc.opts.writeTimeout > 0 {
+		s.rawConn.SetWriteDeadline(time.Now().Add(cc.opts.writeTimeout))
+		defer s.rawConn.SetWriteDeadline(time.Time{})
+	}
+	_, err = s.rawConn.Write(data)
+	return err
+}
@@ -0,0 +1,185 @@
+package tao
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, tc := range []struct {
+		local, peer, want uint32
+	}{
+		{0, 0, 0},
+		{0, 2, 2},
+		{2, 0, 2},
+		{2, 3, 2},
+		{3, 2, 2},
+	} {
+		if got := negotiateVersion(tc.local, tc.peer); got != tc.want {
+			t.Errorf("negotiate %d with %d got %d, want %d", tc.local, tc.peer, got, tc.want)
+		}
+	}
+}
+
+func TestVersionUnmarshalFunc(t *testing.T) {
+	r := NewRouter()
+	versioned := func(v uint32) UnmarshalFunc {
+		return func([]byte) (Message, error) { return numberMessage(v), nil }
+	}
+	double := func(m Message) (Message, error) { return m.(numberMessage) * 2, nil }
+	r.Register(numberMessageNumber, versioned(100), nil,
+		VersionOption(3, versioned(3), nil),
+		VersionOption(1, versioned(1), double),
+	)
+
+	for _, tc := range []struct {
+		version uint32
+		want    numberMessage
+	}{
+		{0, 100},
+		{1, 2}, // upconverted
+		{2, 3},
+		{3, 3},
+		{4, 100},
+	} {
+		msg, err := r.VersionUnmarshalFunc(numberMessageNumber, tc.version)(nil)
+		if err != nil || msg != tc.want {
+			t.Errorf("unmarshaled of version %d got (%v, %v), want %d", tc.version, msg, err, tc.want)
+		}
+	}
+	if r.VersionUnmarshalFunc(textMessageNumber, 1) != nil {
+		t.Fatal("message not registered found")
+	}
+}
+
+// versionErrors returns a ServerOption reporting errors of version
+// negotiation to the channel returned.
+func versionErrors() (ServerOption, <-chan error) {
+	errs := make(chan error, 1)
+	return OnConnErrorOption(func(_ WriteCloser, err *ConnError) {
+		if err.Kind == ErrorHandshake {
+			errs <- err
+		}
+	}), errs
+}
+
+// writeFrame encodes msg and writes it to conn.
+func writeFrame(t *testing.T, conn net.Conn, msg Message) {
+	t.Helper()
+	data, err := TypeLengthValueCodec{}.Encode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectUnexpectedVersion waits for ErrUnexpectedVersion reported and the
+// connection closed without any version answered.
+func expectUnexpectedVersion(t *testing.T, errs <-chan error, conn net.Conn) {
+	t.Helper()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrUnexpectedVersion) {
+			t.Fatalf("got %v, want ErrUnexpectedVersion", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unexpected version not reported")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if msg, err := (TypeLengthValueCodec{}).Decode(conn); err == nil {
+		t.Fatalf("read %#v, want connection closed", msg)
+	}
+}
+
+func TestVersionNegotiatedOnce(t *testing.T) {
+	onError, errs := versionErrors()
+	_, addr := startServer(t, ProtocolVersionOption(2), onError)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	writeFrame(t, conn, VersionMessage{Version: 3})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := TypeLengthValueCodec{}.Decode(conn)
+	if err != nil || msg != (VersionMessage{Version: 2}) {
+		t.Fatalf("answered (%#v, %v), want version 2", msg, err)
+	}
+
+	writeFrame(t, conn, VersionMessage{Version: 1})
+	expectUnexpectedVersion(t, errs, conn)
+}
+
+func TestVersionNotFirst(t *testing.T) {
+	onError, errs := versionErrors()
+	// heart beats echoed tell the first frame handled
+	_, addr := startServer(t, ProtocolVersionOption(2), HeartbeatOption(0, time.Minute), onError)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	writeFrame(t, conn, HeartBeatMessage{Timestamp: 1})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if msg, err := (TypeLengthValueCodec{}).Decode(conn); err != nil || msg.MessageNumber() != HeartBeat {
+		t.Fatalf("answered (%#v, %v), want heart beat echoed", msg, err)
+	}
+
+	writeFrame(t, conn, VersionMessage{Version: 3})
+	expectUnexpectedVersion(t, errs, conn)
+}
+
+func TestClientVersion(t *testing.T) {
+	s, addr := startServer(t, ProtocolVersionOption(2))
+	cc, err := Dial(context.Background(), "tcp", addr, ProtocolVersionOption(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Start()
+	defer cc.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for cc.Version() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("client version %d, want 2", cc.Version())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	conns := s.conns.Snapshot()
+	if len(conns) != 1 || conns[0].Version() != 2 {
+		t.Fatal("server version not negotiated to 2")
+	}
+}
+
+func TestClientVersionNotAsked(t *testing.T) {
+	_, addr := startServer(t, OnConnectOption(func(c WriteCloser) bool {
+		c.Write(VersionMessage{Version: 1})
+		return true
+	}))
+	onError, errs := versionErrors()
+	cc, err := Dial(context.Background(), "tcp", addr, onError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Start()
+	defer cc.Close()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrUnexpectedVersion) {
+			t.Fatalf("got %v, want ErrUnexpectedVersion", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("version not asked for accepted")
+	}
+	if v := cc.Version(); v != 0 {
+		t.Fatalf("client version %d, want 0", v)
+	}
+}
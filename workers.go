@@ -1,17 +1,55 @@
 // Worker pool is a pool of go-routines running for executing callbacks,
-// each client's message handler is permanently hashed into one specified
-// worker to execute, so it is in-order for each client's perspective.
+// each client's callbacks are queued by key, and a key is served by at most
+// one worker at a time, so it is in-order for each client's perspective.
+// The pool grows when callbacks wait too long in queue, and shrinks when
+// workers stay idle.
 
 package tao
 
 import (
+	"context"
+	"reflect"
+	"sync"
 	"time"
 )
 
+const (
+	// workerScaleLatency is the queueing latency above which pool grows.
+	workerScaleLatency = 10 * time.Millisecond
+	// workerIdleTimeout is the idle time after which a worker above the
+	// minimum exits.
+	workerIdleTimeout = 30 * time.Second
+)
+
 // WorkerPool is a pool of go-routines running functions.
 type WorkerPool struct {
-	workers   []*worker
-	closeChan chan struct{}
+	queueSize    int
+	scaleLatency time.Duration
+	idleTimeout  time.Duration
+	closeChan    chan struct{}
+	signal       chan struct{} // wakes up an idle worker
+	mu           sync.Mutex    // guards following
+	minSize      int
+	maxSize      int
+	size         int
+	idle         int
+	keys         map[interface{}]*keyQueue
+	ready        []*keyQueue
+	closed       bool
+	logger       LoggerInterface
+}
+
+// keyQueue holds callbacks of one key, it is in the ready list or being run by
+// a worker whenever it is not empty.
+type keyQueue struct {
+	key   interface{}
+	tasks []task
+	space chan struct{} // closed when a task is taken, for PutWait
+}
+
+type task struct {
+	cb       workerFunc
+	enqueued time.Time
 }
 
 var (
@@ -19,7 +57,7 @@ var (
 )
 
 func init() {
-	globalWorkerPool = newWorkerPool(WorkersNum)
+	globalWorkerPool = newWorkerPool(WorkersNum, MaxWorkersNum, nil)
 }
 
 // WorkerPoolInstance returns the global pool.
@@ -27,71 +65,260 @@ func WorkerPoolInstance() *WorkerPool {
 	return globalWorkerPool
 }
 
-func newWorkerPool(vol int) *WorkerPool {
-	if vol <= 0 {
-		vol = WorkersNum
+func newWorkerPool(minSize, maxSize int, logger LoggerInterface) *WorkerPool {
+	return newWorkerPoolTimed(minSize, maxSize, logger, workerScaleLatency, workerIdleTimeout)
+}
+
+// newWorkerPoolTimed returns a pool growing when callbacks wait longer than
+// scaleLatency and shrinking when workers stay idle for idleTimeout.
+func newWorkerPoolTimed(minSize, maxSize int, logger LoggerInterface, scaleLatency, idleTimeout time.Duration) *WorkerPool {
+	if minSize <= 0 {
+		minSize = WorkersNum
+	}
+	if maxSize < minSize {
+		maxSize = minSize
 	}
 
 	pool := &WorkerPool{
-		workers:   make([]*worker, vol),
-		closeChan: make(chan struct{}),
+		queueSize:    DefaultQueueSize,
+		scaleLatency: scaleLatency,
+		idleTimeout:  idleTimeout,
+		closeChan:    make(chan struct{}),
+		signal:       make(chan struct{}, 1),
+		minSize:      minSize,
+		maxSize:      maxSize,
+		keys:         make(map[interface{}]*keyQueue),
+		logger:       logger,
 	}
 
-	for i := range pool.workers {
-		pool.workers[i] = newWorker(i, 1024, pool.closeChan)
-		if pool.workers[i] == nil {
-			panic("worker nil")
-		}
+	pool.mu.Lock()
+	for i := 0; i < minSize; i++ {
+		pool.spawn()
 	}
+	pool.mu.Unlock()
 
 	return pool
 }
 
-// Put appends a function to some worker's channel.
+// Size returns the number of worker go-routines running.
+func (wp *WorkerPool) Size() int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.size
+}
+
+// SetSize changes the minimum and maximum number of worker go-routines.
+func (wp *WorkerPool) SetSize(minSize, maxSize int) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if minSize <= 0 {
+		minSize = 1
+	}
+	if maxSize < minSize {
+		maxSize = minSize
+	}
+	wp.minSize, wp.maxSize = minSize, maxSize
+	for wp.size < wp.minSize && !wp.closed {
+		wp.spawn()
+	}
+}
+
+// Put appends a function to the queue of k, k must be comparable.
 func (wp *WorkerPool) Put(k interface{}, cb func()) error {
-	code := hashCode(k)
-	return wp.workers[code&uint32(len(wp.workers)-1)].put(workerFunc(cb))
+	_, err := wp.put(k, workerFunc(cb))
+	return err
+}
+
+// PutWait appends a function to the queue of k, blocking until there is room
+// for it, ctx is done or the pool is closed.
+func (wp *WorkerPool) PutWait(ctx context.Context, k interface{}, cb func()) error {
+	saturated := false
+	for {
+		space, err := wp.put(k, workerFunc(cb))
+		if err != ErrWouldBlock {
+			return err
+		}
+		if !saturated {
+			saturated = true
+			addTotalSaturated()
+		}
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wp.closeChan:
+			return ErrServerClosed
+		}
+	}
 }
 
 // Close closes the pool, stopping it from executing functions.
 func (wp *WorkerPool) Close() {
-	close(wp.closeChan)
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if !wp.closed {
+		wp.closed = true
+		close(wp.closeChan)
+	}
 }
 
-type worker struct {
-	index        int
-	callbackChan chan workerFunc
-	closeChan    chan struct{}
+// put queues cb, or returns ErrWouldBlock along with a channel closed when
+// there may be room for it.
+func (wp *WorkerPool) put(k interface{}, cb workerFunc) (<-chan struct{}, error) {
+	if k == nil {
+		return nil, ErrNilKey
+	}
+	if !reflect.TypeOf(k).Comparable() {
+		return nil, ErrNotHashable
+	}
+
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.closed {
+		return nil, ErrServerClosed
+	}
+
+	kq, ok := wp.keys[k]
+	if !ok {
+		kq = &keyQueue{key: k}
+		wp.keys[k] = kq
+	}
+	if len(kq.tasks) >= wp.queueSize {
+		if kq.space == nil {
+			kq.space = make(chan struct{})
+		}
+		return kq.space, ErrWouldBlock
+	}
+	kq.tasks = append(kq.tasks, task{cb: cb, enqueued: time.Now()})
+	if !ok {
+		// a known key is either ready or being run, which puts it back
+		// when done.
+		wp.ready = append(wp.ready, kq)
+		wp.wakeup()
+	}
+	wp.scale()
+	return nil, nil
+}
+
+// spawn starts a worker, it must be called with wp.mu held.
+func (wp *WorkerPool) spawn() {
+	wp.size++
+	wp.idle++
+	go wp.work(wp.size - 1)
 }
 
-func newWorker(i int, c int, closeChan chan struct{}) *worker {
-	w := &worker{
-		index:        i,
-		callbackChan: make(chan workerFunc, c),
-		closeChan:    closeChan,
+// wakeup signals an idle worker if any, it must be called with wp.mu held.
+func (wp *WorkerPool) wakeup() {
+	if wp.idle == 0 {
+		return
+	}
+	select {
+	case wp.signal <- struct{}{}:
+	default:
+	}
+}
+
+// scale starts a new worker if the oldest ready callback has waited too long
+// and the pool is not full, it must be called with wp.mu held.
+func (wp *WorkerPool) scale() {
+	if wp.closed || wp.size >= wp.maxSize || len(wp.ready) == 0 {
+		return
+	}
+	if time.Since(wp.ready[0].tasks[0].enqueued) > wp.scaleLatency {
+		wp.spawn()
+	}
+}
+
+// next takes the first task of the first ready key, the key is owned by the
+// caller until done is called.
+func (wp *WorkerPool) next() (*keyQueue, task, bool) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if len(wp.ready) == 0 {
+		return nil, task{}, false
+	}
+	kq := wp.ready[0]
+	wp.ready[0] = nil
+	wp.ready = wp.ready[1:]
+	t := kq.tasks[0]
+	kq.tasks[0] = task{}
+	kq.tasks = kq.tasks[1:]
+	if kq.space != nil {
+		close(kq.space)
+		kq.space = nil
+	}
+	wp.idle--
+	if len(wp.ready) > 0 {
+		wp.wakeup()
 	}
-	go w.start()
-	return w
+	wp.scale()
+	return kq, t, true
 }
 
-func (w *worker) start() {
+// done puts kq back to the end of ready list if it still has tasks, so that
+// keys are served in turn.
+func (wp *WorkerPool) done(kq *keyQueue) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.idle++
+	if len(kq.tasks) == 0 {
+		delete(wp.keys, kq.key)
+		return
+	}
+	wp.ready = append(wp.ready, kq)
+}
+
+// retire tells whether an idle worker above the minimum should exit.
+func (wp *WorkerPool) retire() bool {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.size <= wp.minSize || len(wp.ready) > 0 {
+		return false
+	}
+	wp.size--
+	wp.idle--
+	return true
+}
+
+func (wp *WorkerPool) work(index int) {
+	idle := time.NewTimer(wp.idleTimeout)
+	defer idle.Stop()
 	for {
-		select {
-		case <-w.closeChan:
-			return
-		case cb := <-w.callbackChan:
+		if kq, t, ok := wp.next(); ok {
 			before := time.Now()
-			cb()
+			wp.run(index, t.cb)
 			addTotalTime(time.Since(before).Seconds())
+			wp.done(kq)
+			continue
+		}
+
+		idle.Reset(wp.idleTimeout)
+		select {
+		case <-wp.closeChan:
+			return
+		case <-wp.signal:
+		case <-idle.C:
+			if wp.retire() {
+				return
+			}
 		}
 	}
 }
 
-func (w *worker) put(cb workerFunc) error {
-	select {
-	case w.callbackChan <- cb:
-		return nil
-	default:
-		return ErrWouldBlock
-	}
+// run runs cb, recovering from any panic so that the worker keeps serving
+// other keys.
+func (wp *WorkerPool) run(index int, cb workerFunc) {
+	defer func() {
+		if p := recover(); p != nil {
+			if _, ok := p.(fatalPanic); ok {
+				panic(p)
+			}
+			if wp.logger != nil {
+				wp.logger.Errorf("worker %d panics: %v\n%s", index, p, stackTrace())
+			} else {
+				printStack()
+			}
+		}
+	}()
+	cb()
 }
@@ -0,0 +1,171 @@
+package tao
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitSize waits for wp running n workers.
+func waitSize(t *testing.T, wp *WorkerPool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for wp.Size() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d workers running, want %d", wp.Size(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blocker returns a callback blocked until release is closed, started is
+// sent to once it runs.
+func blocker(started chan<- struct{}, release <-chan struct{}) func() {
+	return func() {
+		started <- struct{}{}
+		<-release
+	}
+}
+
+func TestWorkersKeyInOrder(t *testing.T) {
+	const keys, jobs = 8, 200
+	wp := newWorkerPoolTimed(2, 8, nil, time.Millisecond, time.Second)
+	defer wp.Close()
+
+	var (
+		wg      sync.WaitGroup
+		running [keys]*AtomicInt32
+		seqs    [keys][]int
+	)
+	for k := range running {
+		running[k] = NewAtomicInt32(0)
+	}
+	for i := 0; i < jobs; i++ {
+		for k := 0; k < keys; k++ {
+			k, i := k, i
+			wg.Add(1)
+			err := wp.PutWait(context.Background(), k, func() {
+				defer wg.Done()
+				if !running[k].CompareAndSet(0, 1) {
+					t.Errorf("jobs of key %d run at the same time", k)
+				}
+				seqs[k] = append(seqs[k], i)
+				time.Sleep(time.Microsecond)
+				running[k].Set(0)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wg.Wait()
+
+	for k, seq := range seqs {
+		if len(seq) != jobs {
+			t.Fatalf("key %d ran %d jobs, want %d", k, len(seq), jobs)
+		}
+		for i, n := range seq {
+			if n != i {
+				t.Fatalf("key %d ran job %d at %d", k, n, i)
+			}
+		}
+	}
+}
+
+func TestWorkersGrowAndShrink(t *testing.T) {
+	wp := newWorkerPoolTimed(1, 4, nil, time.Millisecond, 20*time.Millisecond)
+	defer wp.Close()
+	started, release := make(chan struct{}, 8), make(chan struct{})
+
+	// jobs of different keys waiting for the only worker
+	for k := 0; k < 6; k++ {
+		wp.Put(k, blocker(started, release))
+	}
+	time.Sleep(5 * time.Millisecond)
+	wp.Put(6, blocker(started, release))
+	waitSize(t, wp, 4)
+	for i := 0; i < 4; i++ {
+		<-started
+	}
+	time.Sleep(5 * time.Millisecond)
+	wp.Put(7, blocker(started, release))
+	if n := wp.Size(); n != 4 {
+		t.Fatalf("%d workers running, want at most 4", n)
+	}
+
+	close(release)
+	for i := 0; i < 4; i++ {
+		<-started
+	}
+	waitSize(t, wp, 1)
+}
+
+func TestWorkersSetSize(t *testing.T) {
+	wp := newWorkerPoolTimed(1, 1, nil, time.Millisecond, 20*time.Millisecond)
+	defer wp.Close()
+
+	wp.SetSize(3, 5)
+	if n := wp.Size(); n != 3 {
+		t.Fatalf("%d workers running, want the new minimum 3", n)
+	}
+	wp.SetSize(0, 0)
+	wp.mu.Lock()
+	minSize, maxSize := wp.minSize, wp.maxSize
+	wp.mu.Unlock()
+	if minSize != 1 || maxSize != 1 {
+		t.Fatalf("size set to (%d, %d), want (1, 1)", minSize, maxSize)
+	}
+	waitSize(t, wp, 1)
+}
+
+func TestWorkersPutWait(t *testing.T) {
+	wp := newWorkerPoolTimed(1, 1, nil, time.Millisecond, time.Second)
+	wp.mu.Lock()
+	wp.queueSize = 1
+	wp.mu.Unlock()
+	started, release := make(chan struct{}, 2), make(chan struct{})
+
+	wp.Put(0, blocker(started, release))
+	<-started
+	wp.Put(0, blocker(started, release))
+	if err := wp.Put(0, func() {}); err != ErrWouldBlock {
+		t.Fatalf("Put to full key got %v, want ErrWouldBlock", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := wp.PutWait(ctx, 0, func() {}); err != context.DeadlineExceeded {
+		t.Fatalf("PutWait to full key got %v, want context.DeadlineExceeded", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- wp.PutWait(context.Background(), 0, func() {}) }()
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("PutWait got %v after room made", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("PutWait blocked after room made")
+	}
+
+	// full again, then closed
+	<-started
+	release2 := make(chan struct{})
+	wp.Put(1, blocker(started, release2))
+	<-started
+	wp.Put(1, func() {})
+	go func() { done <- wp.PutWait(context.Background(), 1, func() {}) }()
+	wp.Close()
+	close(release2)
+	select {
+	case err := <-done:
+		if err != ErrServerClosed {
+			t.Fatalf("PutWait got %v after closed, want ErrServerClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("PutWait blocked after closed")
+	}
+}